@@ -1,15 +1,18 @@
 package suede
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 type WSClientError struct {
@@ -20,13 +23,103 @@ func (err *WSClientError) Error() string {
 	return err.message
 }
 
+// maxHandshakeErrorBody limits how much of a rejected handshake's response body is kept.
+const maxHandshakeErrorBody = 4096
+
+// WSHandshakeError is returned when the server does not accept the WebSocket upgrade. It carries
+// the server's response, so that, for example, a 401 or 403 can be told apart from a 404.
+type WSHandshakeError struct {
+	message    string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	// Body holds the start of the response body when the server replied with a status other
+	// than 101 Switching Protocols.
+	Body []byte
+}
+
+func (err *WSHandshakeError) Error() string {
+	return err.message
+}
+
 type wsclient struct {
-	host         string
-	path         string
-	OnConnect    func()
-	OnDisconnect func()
+	host    string
+	address string
+	url     *url.URL
+	secure  bool
+	// Header holds additional headers to send with the handshake request, such as Authorization
+	// or Origin. Headers required by the WebSocket handshake itself are always set by the client.
+	Header http.Header
+	// Jar, if set, supplies cookies for the handshake request, and stores any cookies set by the
+	// server's response.
+	Jar http.CookieJar
+	// Subprotocols lists the subprotocols offered to the server, in order of preference. The one
+	// chosen by the server is reported by Subprotocol once connected.
+	Subprotocols []string
+	// Compression, if set, offers permessage-deflate compression to the server.
+	Compression *CompressionOptions
+	// Extensions lists additional extensions to offer to the server, after Compression, in order
+	// of preference.
+	Extensions     []ExtensionFactory
+	responseHeader http.Header
+	// PingInterval, if set, pings the server at that interval to keep the connection alive. If no
+	// pong arrives within PongTimeout, which defaults to PingInterval, the connection is dropped
+	// and OnDisconnect reports CloseAbnormalClosure.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// OnPing receives the payload of each ping sent by the server, after the pong echoing it has
+	// been sent.
+	OnPing func(payload []byte)
+	// OnPong receives the payload of each pong sent by the server, and the round-trip time of the
+	// ping it answers. Unsolicited pongs have a latency of zero.
+	OnPong func(payload []byte, latency time.Duration)
+	// MaxFrameSize and MaxMessageSize limit the size of frames and messages received from the
+	// server, where zero means no limit. Compressed messages are limited by their decompressed
+	// size. A larger frame or message fails the connection with CloseMessageTooBig.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	// HandshakeTimeout limits how long dialing and the opening handshake may take. ReadTimeout
+	// limits how long to wait for each frame from the server, so the connection is dropped once
+	// the server falls silent; PingInterval should be shorter, so that pongs keep a quiet
+	// connection open. WriteTimeout limits how long each frame may take to send. Zero disables a
+	// timeout, and any that expires returns or reports a *WSTimeoutError.
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	// OnError is called with the error whenever the connection fails because the server broke the
+	// protocol, sent a message which is too big, timed out, or the connection broke unexpectedly.
+	OnError func(error)
+	// TLSConfig configures the TLS connection made for wss:// and https:// URLs, such as custom
+	// root CAs or client certificates. If ServerName is unset, the URL's hostname is used.
+	TLSConfig *tls.Config
+	OnConnect func()
+	// OnDisconnect receives the close status sent by the server, or CloseAbnormalClosure if the
+	// connection was lost without a closing handshake.
+	OnDisconnect func(CloseCode, string)
 	OnMessage    func([]byte)
-	connection   *net.Conn
+	// OnTypedMessage is called alongside OnMessage, and also receives whether the message was
+	// sent as text or binary data.
+	OnTypedMessage func(MessageType, []byte)
+	// Reconnect, if set, reconnects to the server whenever the connection is lost, until the
+	// client is closed with Close.
+	Reconnect *ReconnectPolicy
+	// OnReconnecting is called before each reconnection attempt, counting from 1, with the delay
+	// before the attempt is made.
+	OnReconnecting func(attempt int, delay time.Duration)
+	// OnReconnect is called once the client has reconnected, with the number of attempts it took.
+	OnReconnect func(attempt int)
+	// OnReconnectFailed is called with the last attempt's error once MaxAttempts is reached and
+	// the client gives up.
+	OnReconnectFailed func(error)
+
+	// stateMutex guards the connection, which is replaced whenever the client reconnects, along
+	// with the messages queued while offline. stop is closed by Close to cancel reconnection.
+	stateMutex sync.Mutex
+	connection *WSConnection
+	online     bool
+	closed     bool
+	stop       chan struct{}
+	queue      []queuedMessage
 }
 
 func WebSocket(rawURL string) (*wsclient, error) {
@@ -36,9 +129,39 @@ func WebSocket(rawURL string) (*wsclient, error) {
 		return nil, urlErr
 	}
 
+	var secure bool
+	var defaultPort string
+	var httpScheme string
+	switch strings.ToLower(urlObject.Scheme) {
+	case "ws", "http":
+		defaultPort = "80"
+		httpScheme = "http"
+	case "wss", "https":
+		secure = true
+		defaultPort = "443"
+		httpScheme = "https"
+	default:
+		return nil, &WSClientError{message: fmt.Sprintf("Unsupported URL scheme %q", urlObject.Scheme)}
+	}
+
+	requestURL := &url.URL{
+		Scheme:   httpScheme,
+		Host:     urlObject.Host,
+		Path:     urlObject.Path,
+		RawPath:  urlObject.RawPath,
+		RawQuery: urlObject.RawQuery,
+	}
+
+	port := urlObject.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
 	wsClient := &wsclient{
-		host: urlObject.Host,
-		path: urlObject.Path,
+		host:    urlObject.Host,
+		address: net.JoinHostPort(urlObject.Hostname(), port),
+		url:     requestURL,
+		secure:  secure,
 	}
 
 	return wsClient, nil
@@ -51,17 +174,34 @@ func WebSocket(rawURL string) (*wsclient, error) {
 //
 // If the caller does not need to regain control, consider calling Run or RuCallback instead.
 func (wsClient *wsclient) Connect(wg *sync.WaitGroup) error {
-	connectionErr := wsClient.handleConnection()
+	return wsClient.DialContext(context.Background(), wg)
+}
+
+// DialContext behaves like Connect, but abandons the handshake if ctx is done before it completes.
+// Once connected, cancelling ctx closes the connection with CloseGoingAway and stops the client
+// reconnecting.
+func (wsClient *wsclient) DialContext(ctx context.Context, wg *sync.WaitGroup) error {
+	wsClient.stateMutex.Lock()
+	wsClient.closed = false
+	wsClient.stop = make(chan struct{})
+	wsClient.stateMutex.Unlock()
+
+	connection, connectionErr := wsClient.handleConnection(ctx)
 	if connectionErr != nil {
 		return connectionErr
 	}
 
+	if onlineErr := wsClient.goOnline(ctx, connection); onlineErr != nil {
+		connection.drop(CloseNormalClosure, "")
+		return onlineErr
+	}
+
 	if wsClient.OnConnect != nil {
 		wsClient.OnConnect()
 	}
 
 	wg.Add(1)
-	go wsClient.readFromConnection(wg)
+	go wsClient.readFromConnection(ctx, wg, connection)
 
 	return nil
 }
@@ -98,207 +238,512 @@ func (wsClient *wsclient) Run() error {
 	return runErr
 }
 
-func (wsClient *wsclient) handleConnection() error {
-	conn, connErr := net.Dial("tcp", wsClient.host)
+// RunContext connects to the WebSocket server and does not return control to the caller until the
+// client disconnects, or ctx is done. Cancelling ctx closes the connection with CloseGoingAway,
+// and RunContext then returns ctx.Err() once the connection has closed, which takes at most five
+// seconds if the server stops responding.
+func (wsClient *wsclient) RunContext(ctx context.Context) error {
+	var wg sync.WaitGroup
+	dialErr := wsClient.DialContext(ctx, &wg)
+	if dialErr != nil {
+		return dialErr
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// handleConnection dials the server and completes the opening handshake, returning the new
+// connection. If ctx is done first, the handshake is abandoned and ctx.Err() is returned.
+func (wsClient *wsclient) handleConnection(ctx context.Context) (*WSConnection, error) {
+	handshakeCtx := ctx
+	if wsClient.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, wsClient.HandshakeTimeout)
+		defer cancel()
+	}
+
+	conn, connErr := wsClient.dial(handshakeCtx)
 	if connErr != nil {
 		fmt.Printf("Error connecting to %s, terminating connection.\n", wsClient.host)
 		if conn != nil {
 			conn.Close()
 		}
-		return connErr
+		return nil, wsClient.handshakeFailure(ctx, handshakeCtx, connErr)
+	}
+
+	stopInterrupt := interruptOnDone(handshakeCtx, conn.SetDeadline)
+	connection, handshakeErr := wsClient.handshake(conn)
+	if stopInterrupt() {
+		conn.Close()
+		return nil, wsClient.handshakeFailure(ctx, handshakeCtx, handshakeCtx.Err())
+	}
+
+	if handshakeErr != nil {
+		return nil, handshakeErr
 	}
 
-	wsClient.connection = &conn
+	connection.setSizeLimits(wsClient.MaxFrameSize, wsClient.MaxMessageSize)
+	connection.setTimeouts(wsClient.ReadTimeout, wsClient.WriteTimeout)
+	connection.onError = wsClient.OnError
+	connection.keepalive.onPing = wsClient.OnPing
+	connection.keepalive.onPong = wsClient.OnPong
+	connection.startKeepalive(wsClient.PingInterval, wsClient.PongTimeout)
 
+	return connection, nil
+}
+
+// handshake sends the opening handshake over conn and validates the server's response. conn is
+// closed if the handshake fails.
+func (wsClient *wsclient) handshake(conn net.Conn) (*WSConnection, error) {
 	wsKey := GenerateWSKey()
 	wsAccept := GenerateWSAccept(wsKey)
 
-	var content []byte
-	content = append(content, fmt.Sprintf("GET %s HTTP/1.1\r\n", wsClient.path)...)
-	content = append(content, fmt.Sprintf("Host: %s\r\n", wsClient.host)...)
-	content = append(content, "Upgrade: websocket\r\n"...)
-	content = append(content, "Connection: Upgrade\r\n"...)
-	content = append(content, "Sec-WebSocket-Version: 13\r\n"...)
-	content = append(content, fmt.Sprintf("Sec-WebSocket-Key: %s", wsKey)...)
-	content = append(content, "\r\n\r\n"...)
-	conn.Write(content)
-
-	ackBuffer := make([]byte, 256)
-	_, readErr := conn.Read(ackBuffer)
+	offered := newExtensions(wsClient.Compression, wsClient.Extensions)
+	request := wsClient.handshakeRequest(wsKey, offered)
+	if writeErr := request.Write(conn); writeErr != nil {
+		conn.Close()
+		return nil, writeErr
+	}
+
+	reader := bufio.NewReader(conn)
+	response, readErr := http.ReadResponse(reader, request)
 	if readErr != nil {
-		fmt.Println(readErr.Error())
+		fmt.Printf("Read Error: %s\n", readErr.Error())
 		conn.Close()
-		return readErr
+		return nil, readErr
 	}
 
-	responseReader := bytes.NewBuffer(ackBuffer)
-	for true {
-		line, readStrError := responseReader.ReadString('\n')
-		if readStrError != nil {
-			if readStrError == io.EOF {
+	if wsClient.Jar != nil {
+		if cookies := response.Cookies(); len(cookies) > 0 {
+			wsClient.Jar.SetCookies(wsClient.url, cookies)
+		}
+	}
+
+	validateErr := validateHandshakeResponse(response, string(wsAccept))
+	if validateErr != nil {
+		conn.Close()
+		return nil, validateErr
+	}
+
+	subprotocol, subprotocolErr := wsClient.acceptSubprotocol(response)
+	if subprotocolErr != nil {
+		conn.Close()
+		return nil, subprotocolErr
+	}
+
+	extensions, extensionErr := wsClient.acceptExtensions(response, offered)
+	if extensionErr != nil {
+		conn.Close()
+		return nil, extensionErr
+	}
+
+	wsClient.stateMutex.Lock()
+	wsClient.responseHeader = response.Header
+	wsClient.stateMutex.Unlock()
+
+	connection := newWSConnection(0, conn, reader, request, true)
+	connection.subprotocol = subprotocol
+	connection.useExtensions(extensions)
+
+	return connection, nil
+}
+
+// acceptExtensions applies the extensions accepted by the server, which must be among those the
+// client offered, each accepted at most once, and without two of them using the same reserved
+// bits.
+func (wsClient *wsclient) acceptExtensions(response *http.Response, offered []Extension) ([]Extension, error) {
+	var accepted []Extension
+	var usedBits byte
+	for _, element := range parseExtensions(response.Header) {
+		var extension Extension
+		for index, candidate := range offered {
+			if candidate != nil && candidate.Name() == element.name {
+				extension = candidate
+				offered[index] = nil
 				break
 			}
-
-			fmt.Printf("Read Error: %s\n", readStrError.Error())
-			conn.Close()
-			return readStrError
 		}
 
-		switch {
-		case strings.HasPrefix(line, "Upgrade"):
-			if !strings.HasSuffix(line, "websocket\r\n") {
-				fmt.Println("Response not a WebSocket upgrade")
-				return &WSClientError{message: "Server response not a WebSocket upgrade"}
+		if extension == nil {
+			return nil, &WSHandshakeError{
+				message:    fmt.Sprintf("Server accepted extension %q which was not offered", element.name),
+				StatusCode: response.StatusCode,
+				Status:     response.Status,
+				Header:     response.Header,
 			}
+		}
 
-		case strings.HasPrefix(line, "Sec-WebSocket-Accept"):
-			headerValue := strings.Split(line, ": ")[1]
-			if strings.TrimSpace(headerValue) != string(wsAccept) {
-				fmt.Printf("Invalid WS Key.\nExpected: %s\nReceived: %s\n",
-					wsAccept, headerValue)
-				return &WSClientError{message: "Server responded with invalid WebSocket key"}
+		if extension.ReservedBits()&usedBits != 0 {
+			return nil, &WSHandshakeError{
+				message:    fmt.Sprintf("Server accepted extension %q whose reserved bits are already in use", element.name),
+				StatusCode: response.StatusCode,
+				Status:     response.Status,
+				Header:     response.Header,
 			}
 		}
+
+		if acceptErr := extension.Accept(element.params); acceptErr != nil {
+			return nil, acceptErr
+		}
+
+		accepted = append(accepted, extension)
+		usedBits |= extension.ReservedBits()
 	}
 
-	return nil
+	return accepted, nil
 }
 
-func (wsClient *wsclient) readFromConnection(wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer (*wsClient.connection).Close()
+// acceptSubprotocol returns the subprotocol chosen by the server, which must be one the client
+// offered.
+func (wsClient *wsclient) acceptSubprotocol(response *http.Response) (string, error) {
+	chosen := headerTokens(response.Header, "Sec-WebSocket-Protocol")
+	if len(chosen) == 0 {
+		return "", nil
+	}
 
-	if wsClient.OnDisconnect != nil {
-		defer wsClient.OnDisconnect()
+	if len(chosen) > 1 {
+		return "", &WSHandshakeError{
+			message:    "Server selected more than one subprotocol",
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+		}
 	}
 
-	readBuffer := make([]byte, 256)
+	for _, offered := range wsClient.Subprotocols {
+		if offered == chosen[0] {
+			return chosen[0], nil
+		}
+	}
 
-ReadForever:
-	for true {
-		bytesRead, readErr := (*wsClient.connection).Read(readBuffer)
-		if readErr != nil {
-			fmt.Printf("Read Error: %s\n", readErr.Error())
-			break ReadForever
+	return "", &WSHandshakeError{
+		message:    fmt.Sprintf("Server selected subprotocol %q which was not offered", chosen[0]),
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Header:     response.Header,
+	}
+}
+
+// handshakeRequest builds the opening handshake request, combining the client's custom headers
+// and cookies with the headers the handshake requires.
+func (wsClient *wsclient) handshakeRequest(wsKey string, extensions []Extension) *http.Request {
+	header := make(http.Header)
+	for name, values := range wsClient.Header {
+		header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	host := wsClient.host
+	if customHost := header.Get("Host"); customHost != "" {
+		host = customHost
+	}
+	header.Del("Host")
+
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Version", "13")
+	header.Set("Sec-WebSocket-Key", wsKey)
+	header.Del("Sec-WebSocket-Protocol")
+	if len(wsClient.Subprotocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(wsClient.Subprotocols, ", "))
+	}
+
+	header.Del("Sec-WebSocket-Extensions")
+	if len(extensions) > 0 {
+		offers := make([]string, 0, len(extensions))
+		for _, extension := range extensions {
+			offers = append(offers, extensionOffer{name: extension.Name(), params: extension.Offer()}.String())
+			// a window limit is offered with a fallback, in case the server cannot honour it
+			if deflate, ok := extension.(*deflateExtension); ok {
+				if params, hasFallback := deflate.options.clientFallbackOffer(); hasFallback {
+					offers = append(offers, extensionOffer{name: extension.Name(), params: params}.String())
+				}
+			}
 		}
+		header.Set("Sec-WebSocket-Extensions", strings.Join(offers, ", "))
+	}
+
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        wsClient.url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       host,
+	}
 
-		if bytesRead < 2 {
-			fmt.Println("Not enough bytes for a frame")
-			continue
+	if wsClient.Jar != nil {
+		for _, cookie := range wsClient.Jar.Cookies(wsClient.url) {
+			request.AddCookie(cookie)
 		}
+	}
+
+	return request
+}
+
+// Subprotocol returns the subprotocol selected by the server, or an empty string if none was
+// selected.
+func (wsClient *wsclient) Subprotocol() string {
+	connection := wsClient.currentConnection()
+	if connection == nil {
+		return ""
+	}
 
-		controlByte := readBuffer[0]
-		opCode := controlByte & 0b00001111
-		switch opCode {
-		case 0x8:
-			break ReadForever
+	return connection.Subprotocol()
+}
 
-		case 0x9:
-			// ping
-			fmt.Println("got a ping, sending pong")
-			wsClient.pong(wsClient.connection)
+// ResponseHeader returns the headers of the server's handshake response, once connected.
+func (wsClient *wsclient) ResponseHeader() http.Header {
+	wsClient.stateMutex.Lock()
+	defer wsClient.stateMutex.Unlock()
 
-		case 0xA:
-			// pong
-			fmt.Println("got a pong")
-			continue
+	return wsClient.responseHeader
+}
 
-		default:
+// validateHandshakeResponse checks that the server accepted the WebSocket upgrade. Any bytes the
+// server sent after the response headers remain buffered in the reader the response was read from.
+func validateHandshakeResponse(response *http.Response, wsAccept string) error {
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		defer response.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(response.Body, maxHandshakeErrorBody))
+
+		return &WSHandshakeError{
+			message:    fmt.Sprintf("Server rejected WebSocket upgrade with status %s", response.Status),
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+			Body:       body,
 		}
+	}
 
-		payloadInfoByte := readBuffer[1]
-		mask := payloadInfoByte & 0b10000000
-		if mask > 0 {
-			fmt.Println("Server should not set mask bit")
-			break
+	if !headerContainsToken(response.Header, "Upgrade", "websocket") {
+		return &WSHandshakeError{
+			message:    "Server response not a WebSocket upgrade",
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+		}
+	}
+
+	if !headerContainsToken(response.Header, "Connection", "upgrade") {
+		return &WSHandshakeError{
+			message:    "Server response missing Connection: Upgrade header",
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+		}
+	}
+
+	headerValue := response.Header.Get("Sec-WebSocket-Accept")
+	if headerValue == "" {
+		return &WSHandshakeError{
+			message:    "Server response missing Sec-WebSocket-Accept header",
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+		}
+	}
+
+	if strings.TrimSpace(headerValue) != wsAccept {
+		return &WSHandshakeError{
+			message:    "Server responded with invalid WebSocket key",
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
 		}
+	}
+
+	return nil
+}
+
+// handshakeFailure returns a *WSTimeoutError in place of err if HandshakeTimeout expired, rather
+// than ctx being done.
+func (wsClient *wsclient) handshakeFailure(ctx context.Context, handshakeCtx context.Context, err error) error {
+	if ctx.Err() == nil && errors.Is(handshakeCtx.Err(), context.DeadlineExceeded) {
+		return &WSTimeoutError{Op: "handshake", Duration: wsClient.HandshakeTimeout}
+	}
 
-		payloadLength := payloadInfoByte & 0b01111111
+	return err
+}
 
-		data := make([]byte, payloadLength)
-		switch {
-		case payloadLength < 126:
-			data = wsClient.readFrameData(readBuffer[2:], uint64(payloadLength))
+// dial opens the network connection to the server, negotiating TLS for secure URLs.
+func (wsClient *wsclient) dial(ctx context.Context) (net.Conn, error) {
+	if !wsClient.secure {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", wsClient.address)
+	}
 
-		case payloadLength == 126:
-			sizeBytes := []byte{readBuffer[2], readBuffer[3]}
-			payloadLength16 := binary.BigEndian.Uint16(sizeBytes)
-			data = wsClient.readFrameData(readBuffer[4:], uint64(payloadLength16))
+	var tlsConfig *tls.Config
+	if wsClient.TLSConfig != nil {
+		tlsConfig = wsClient.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
 
-		case payloadLength == 127:
-			sizeBytes := []byte{
-				readBuffer[2], readBuffer[3], readBuffer[4], readBuffer[5],
-				readBuffer[6], readBuffer[7], readBuffer[8], readBuffer[9],
+	if tlsConfig.ServerName == "" {
+		hostname, _, _ := net.SplitHostPort(wsClient.address)
+		tlsConfig.ServerName = hostname
+	}
+
+	dialer := &tls.Dialer{Config: tlsConfig}
+	return dialer.DialContext(ctx, "tcp", wsClient.address)
+}
+
+// readFromConnection reads messages until the connection is lost, then reconnects if the
+// Reconnect policy allows it and carries on reading from the new connection. The client is closed
+// if ctx is done.
+func (wsClient *wsclient) readFromConnection(ctx context.Context, wg *sync.WaitGroup, connection *WSConnection) {
+	defer wg.Done()
+
+	if ctx.Done() != nil {
+		stopped := make(chan struct{})
+		defer close(stopped)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				wsClient.Close(CloseGoingAway, "")
+			case <-stopped:
 			}
-			payloadLength64 := binary.BigEndian.Uint64(sizeBytes)
-			data = wsClient.readFrameData(readBuffer[10:], uint64(payloadLength64))
+		}()
+	}
+
+	for true {
+		closeStatus := wsClient.readMessages(connection)
+		wsClient.goOffline()
+		if wsClient.OnDisconnect != nil {
+			wsClient.OnDisconnect(closeStatus.Code, closeStatus.Reason)
 		}
 
-		if wsClient.OnMessage != nil {
-			wsClient.OnMessage(data)
+		if !wsClient.reconnect(ctx) {
+			break
 		}
+		connection = wsClient.currentConnection()
 	}
 }
 
-func (wsClient *wsclient) readFrameData(readBuffer []byte, length uint64) []byte {
-	data := make([]byte, 0, length)
-	for i := 0; i < len(readBuffer); i++ {
-		data = append(data, readBuffer[i])
-		if uint64(len(data)) == length {
-			break
+// readMessages passes every message received on connection to the callbacks until it closes.
+func (wsClient *wsclient) readMessages(connection *WSConnection) *WSCloseError {
+	for true {
+		messageType, data, readErr := connection.readMessage()
+		if readErr != nil {
+			return connection.finishRead(readErr)
 		}
-	}
 
-	if length <= uint64(len(data)) {
-		return data
-	}
+		if wsClient.OnMessage != nil {
+			wsClient.OnMessage(data)
+		}
 
-	bytesRemaining := length - uint64(len(data))
-	frameBuffer := make([]byte, bytesRemaining)
-	bytesRead, err := (*wsClient.connection).Read(frameBuffer)
-	if err != nil {
-		fmt.Println("Continutation read err")
-		fmt.Println(err.Error())
+		if wsClient.OnTypedMessage != nil {
+			wsClient.OnTypedMessage(messageType, data)
+		}
 	}
 
-	for i := 0; i < bytesRead; i++ {
-		data = append(data, frameBuffer[i])
-	}
+	return nil
+}
+
+// currentConnection returns the client's most recent connection, or nil if it has never
+// connected.
+func (wsClient *wsclient) currentConnection() *WSConnection {
+	wsClient.stateMutex.Lock()
+	defer wsClient.stateMutex.Unlock()
 
-	return data
+	return wsClient.connection
 }
 
-// Sends bytes to connected WebSocket server
+// Sends bytes to connected WebSocket server as a text message. Payloads longer than 125 bytes are
+// sent using the 16-bit or 64-bit extended payload length encodings.
 func (wsClient *wsclient) Send(data []byte) {
-	mask := make([]byte, 4)
-	rand.Read(mask)
+	wsClient.SendText(data)
+}
 
-	maskedData := make([]byte, 0, len(data))
-	for i := 0; i < len(data); i++ {
-		maskedByte := data[i] ^ mask[i%4]
-		maskedData = append(maskedData, maskedByte)
-	}
+// SendText sends data to the connected WebSocket server as a text message.
+func (wsClient *wsclient) SendText(data []byte) {
+	wsClient.sendMessage(TextMessage, data)
+}
+
+// SendBinary sends data to the connected WebSocket server as a binary message.
+func (wsClient *wsclient) SendBinary(data []byte) {
+	wsClient.sendMessage(BinaryMessage, data)
+}
 
-	frameLength := len(maskedData) + 2
-	// TODO: Handle frames when data length > 125
+// SendFragmented sends data to the connected WebSocket server as a single message of the given
+// type, split across multiple frames each carrying at most fragmentSize bytes.
+func (wsClient *wsclient) SendFragmented(messageType MessageType, data []byte, fragmentSize int) {
+	err := checkFragmentSize(fragmentSize)
+	if err == nil {
+		err = wsClient.send(context.Background(), queuedMessage{messageType: messageType, data: data, fragmentSize: fragmentSize})
+	}
+	if err != nil {
+		fmt.Printf("Send error: %s\n", err.Error())
+	}
+}
 
-	frame := make([]byte, 0, frameLength)
-	frame = append(frame, 0x81)
-	frame = append(frame, 0b10000000|byte(len(maskedData)))
-	frame = append(frame, mask...)
-	frame = append(frame, maskedData...)
+// SendContext sends data to the connected WebSocket server as a single message of the given type,
+// giving up once ctx is done. Unlike the other send methods, the error is returned rather than
+// printed. A message abandoned part way through being written leaves the connection unusable, so
+// the connection is then dropped.
+func (wsClient *wsclient) SendContext(ctx context.Context, messageType MessageType, data []byte) error {
+	return wsClient.send(ctx, queuedMessage{messageType: messageType, data: data})
+}
 
-	_, err := (*wsClient.connection).Write(frame)
+func (wsClient *wsclient) sendMessage(messageType MessageType, data []byte) {
+	err := wsClient.send(context.Background(), queuedMessage{messageType: messageType, data: data})
 	if err != nil {
 		fmt.Printf("Send error: %s\n", err.Error())
 	}
 }
 
-func (wsClient *wsclient) Ping() {
-	(*wsClient.connection).Write([]byte{0x89, 0x80})
+// send sends message on the current connection, or queues it while the client is reconnecting.
+func (wsClient *wsclient) send(ctx context.Context, message queuedMessage) error {
+	wsClient.stateMutex.Lock()
+	if !wsClient.online {
+		defer wsClient.stateMutex.Unlock()
+		return wsClient.enqueue(message)
+	}
+	connection := wsClient.connection
+	wsClient.stateMutex.Unlock()
+
+	err := message.sendOn(ctx, connection)
+	if errors.Is(err, ErrConnectionClosed) {
+		// the connection is closing but not yet offline, so queue the message if allowed
+		wsClient.stateMutex.Lock()
+		defer wsClient.stateMutex.Unlock()
+		return wsClient.enqueue(message)
+	}
+
+	return err
 }
 
-func (wsClient *wsclient) pong(connection *net.Conn) {
-	pongPayload := []byte{0x8A, 0x00}
-	(*connection).Write(pongPayload)
+// Close starts the closing handshake with the WebSocket server, sending the given status code and
+// reason. The connection is closed once the server replies, after which OnDisconnect is called.
+// Close also stops the client reconnecting, and discards any messages queued while offline.
+func (wsClient *wsclient) Close(code CloseCode, reason string) error {
+	wsClient.stateMutex.Lock()
+	if !wsClient.closed && wsClient.stop != nil {
+		close(wsClient.stop)
+	}
+	wsClient.closed = true
+	wsClient.queue = nil
+	connection := wsClient.connection
+	online := wsClient.online
+	wsClient.stateMutex.Unlock()
+
+	if !online {
+		return nil
+	}
+
+	return connection.Close(code, reason)
+}
+
+// Ping sends a ping carrying payload, which must be at most 125 bytes, to the server. The server
+// echoes the payload in its pong, which is passed to OnPong.
+func (wsClient *wsclient) Ping(payload []byte) error {
+	connection := wsClient.currentConnection()
+	if connection == nil {
+		return ErrConnectionClosed
+	}
+
+	return connection.Ping(payload)
 }
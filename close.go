@@ -0,0 +1,104 @@
+package suede
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// CloseCode is a WebSocket close status code, as defined in RFC 6455 section 7.4.
+type CloseCode uint16
+
+const (
+	CloseNormalClosure       CloseCode = 1000
+	CloseGoingAway           CloseCode = 1001
+	CloseProtocolError       CloseCode = 1002
+	CloseUnsupportedData     CloseCode = 1003
+	CloseNoStatusReceived    CloseCode = 1005
+	CloseAbnormalClosure     CloseCode = 1006
+	CloseInvalidPayload      CloseCode = 1007
+	ClosePolicyViolation     CloseCode = 1008
+	CloseMessageTooBig       CloseCode = 1009
+	CloseMandatoryExtension  CloseCode = 1010
+	CloseInternalServerError CloseCode = 1011
+	CloseTLSHandshake        CloseCode = 1015
+)
+
+const maxCloseReason = maxControlPayload - 2
+
+// WSCloseError describes why a connection was closed. It is returned when reading from a
+// connection the peer has closed, and carries the status code and reason the peer sent.
+type WSCloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (err *WSCloseError) Error() string {
+	if err.Reason == "" {
+		return fmt.Sprintf("WebSocket closed with status %d", err.Code)
+	}
+
+	return fmt.Sprintf("WebSocket closed with status %d: %s", err.Code, err.Reason)
+}
+
+// sendable reports whether code may be sent in a close frame. Codes 1005, 1006 and 1015 are
+// reserved for reporting locally, and must never appear on the wire.
+func (code CloseCode) sendable() bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeClosePayload builds the payload of a close frame. CloseNoStatusReceived produces an empty
+// payload, which is how a close without a status code is sent.
+func encodeClosePayload(code CloseCode, reason string) ([]byte, error) {
+	if code == CloseNoStatusReceived {
+		return []byte{}, nil
+	}
+
+	if !code.sendable() {
+		return nil, &WSFrameError{message: fmt.Sprintf("Close code %d cannot be sent", code)}
+	}
+
+	if len(reason) > maxCloseReason {
+		return nil, &WSFrameError{message: "Close reason exceeds 123 bytes"}
+	}
+
+	if !utf8.ValidString(reason) {
+		return nil, &WSFrameError{message: "Close reason is not valid UTF-8"}
+	}
+
+	payload := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), uint16(code))
+	payload = append(payload, reason...)
+	return payload, nil
+}
+
+// decodeClosePayload parses the payload of a close frame received from the peer.
+func decodeClosePayload(payload []byte) (*WSCloseError, error) {
+	if len(payload) == 0 {
+		return &WSCloseError{Code: CloseNoStatusReceived}, nil
+	}
+
+	if len(payload) == 1 {
+		return nil, &WSFrameError{message: "Close frame payload too short"}
+	}
+
+	code := CloseCode(binary.BigEndian.Uint16(payload[:2]))
+	if !code.sendable() {
+		return nil, &WSFrameError{message: fmt.Sprintf("Invalid close code %d", code)}
+	}
+
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return nil, &WSFrameError{message: "Close reason is not valid UTF-8", code: CloseInvalidPayload}
+	}
+
+	return &WSCloseError{Code: code, Reason: string(reason)}, nil
+}
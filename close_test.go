@@ -0,0 +1,158 @@
+package suede
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEncodeClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    CloseCode
+		reason  string
+		payload []byte
+	}{
+		{"normal closure", CloseNormalClosure, "", []byte{0x03, 0xE8}},
+		{"with reason", CloseGoingAway, "bye", []byte{0x03, 0xE9, 'b', 'y', 'e'}},
+		{"application code", 4000, "", []byte{0x0F, 0xA0}},
+		{"no status", CloseNoStatusReceived, "ignored", []byte{}},
+		{"longest reason", CloseNormalClosure, strings.Repeat("a", 123), append([]byte{0x03, 0xE8}, strings.Repeat("a", 123)...)},
+	}
+
+	for _, test := range tests {
+		payload, encodeErr := encodeClosePayload(test.code, test.reason)
+		if encodeErr != nil {
+			t.Errorf("%s: encodeClosePayload: %s", test.name, encodeErr)
+			continue
+		}
+
+		if !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: payload %v, want %v", test.name, payload, test.payload)
+		}
+	}
+}
+
+func TestEncodeClosePayloadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   CloseCode
+		reason string
+	}{
+		{"abnormal closure", CloseAbnormalClosure, ""},
+		{"TLS handshake", CloseTLSHandshake, ""},
+		{"unassigned code", 999, ""},
+		{"reserved code", 1012, ""},
+		{"code out of range", 5000, ""},
+		{"reason too long", CloseNormalClosure, strings.Repeat("a", 124)},
+		{"invalid UTF-8 reason", CloseNormalClosure, "\xff"},
+	}
+
+	for _, test := range tests {
+		_, encodeErr := encodeClosePayload(test.code, test.reason)
+		var frameErr *WSFrameError
+		if !errors.As(encodeErr, &frameErr) {
+			t.Errorf("%s: encodeClosePayload returned %v, want a *WSFrameError", test.name, encodeErr)
+		}
+	}
+}
+
+func TestDecodeClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    CloseCode
+		reason  string
+	}{
+		{"empty", []byte{}, CloseNoStatusReceived, ""},
+		{"code only", []byte{0x03, 0xE8}, CloseNormalClosure, ""},
+		{"with reason", []byte{0x03, 0xF3, 'o', 'o', 'p', 's'}, CloseInternalServerError, "oops"},
+		{"application code", []byte{0x0F, 0xA0, 'x'}, 4000, "x"},
+	}
+
+	for _, test := range tests {
+		closeStatus, decodeErr := decodeClosePayload(test.payload)
+		if decodeErr != nil {
+			t.Errorf("%s: decodeClosePayload: %s", test.name, decodeErr)
+			continue
+		}
+
+		if closeStatus.Code != test.code || closeStatus.Reason != test.reason {
+			t.Errorf("%s: decoded %d %q, want %d %q", test.name, closeStatus.Code, closeStatus.Reason, test.code, test.reason)
+		}
+	}
+}
+
+func TestDecodeClosePayloadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    CloseCode
+	}{
+		{"one byte", []byte{0x03}, CloseProtocolError},
+		{"no status code", []byte{0x03, 0xED}, CloseProtocolError},
+		{"abnormal closure", []byte{0x03, 0xEE}, CloseProtocolError},
+		{"unassigned code", []byte{0x00, 0x00}, CloseProtocolError},
+		{"invalid UTF-8 reason", []byte{0x03, 0xE8, 0xC3, 0x28}, CloseInvalidPayload},
+	}
+
+	for _, test := range tests {
+		_, decodeErr := decodeClosePayload(test.payload)
+		var frameErr *WSFrameError
+		if !errors.As(decodeErr, &frameErr) {
+			t.Errorf("%s: decodeClosePayload returned %v, want a *WSFrameError", test.name, decodeErr)
+			continue
+		}
+
+		if frameErr.closeCode() != test.code {
+			t.Errorf("%s: close code %d, want %d", test.name, frameErr.closeCode(), test.code)
+		}
+	}
+}
+
+func TestCloseWaitingBehindAnotherFrame(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, upgradeErr := Upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+		defer connection.conn.Close()
+
+		// never read, so that the client's writes block once the network buffers fill
+		<-release
+	}))
+	defer httpServer.Close()
+
+	wsClient, _ := WebSocket(httpServer.URL)
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	connection := wsClient.currentConnection()
+	defer wg.Wait()
+	defer connection.conn.Close()
+
+	go connection.SendBinary(make([]byte, 64<<20))
+	time.Sleep(50 * time.Millisecond)
+	go connection.Close(CloseNormalClosure, "")
+	time.Sleep(50 * time.Millisecond)
+
+	// the close frame is stuck behind the message, but must not hold up the connection's state
+	checked := make(chan bool, 1)
+	go func() {
+		connection.LastPong()
+		checked <- connection.isClosing()
+	}()
+
+	if closing := receive(t, checked, "connection state"); !closing {
+		t.Errorf("isClosing reported false once Close had been called")
+	}
+}
@@ -0,0 +1,368 @@
+package suede
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	deflateExtensionName = "permessage-deflate"
+	deflateWindowSize    = 1 << 15
+	minWindowBits        = 8
+	maxWindowBits        = 15
+)
+
+var (
+	// deflateTail ends the output of every flush. It is removed from compressed messages before
+	// they are sent, and restored before they are decompressed (RFC 7692 section 7.2).
+	deflateTail = []byte{0x00, 0x00, 0xFF, 0xFF}
+	// deflateFinalBlock is an empty final block, appended when decompressing so the reader sees
+	// the end of the stream.
+	deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xFF, 0xFF}
+)
+
+// CompressionOptions enables and configures the permessage-deflate extension defined in RFC 7692.
+// Compression is only used if both client and server enable it.
+//
+// compress/flate always compresses with a 32KB window, so suede never asks the peer to let it use
+// a smaller one. The window bits options instead limit the window the peer compresses with, which
+// reduces the memory the peer needs for its own compression state.
+type CompressionOptions struct {
+	// Level is the compress/flate compression level to use. The zero value uses
+	// flate.DefaultCompression.
+	Level int
+	// Threshold is the smallest message, in bytes, which is compressed. Smaller messages are sent
+	// uncompressed, as compression rarely helps them.
+	Threshold int
+	// ClientNoContextTakeover resets the client's compression state after every message.
+	ClientNoContextTakeover bool
+	// ServerNoContextTakeover resets the server's compression state after every message.
+	ServerNoContextTakeover bool
+	// ClientMaxWindowBits is used by servers to limit the client's window to 2^n bytes, where n is
+	// between 8 and 15. It is ignored by clients.
+	ClientMaxWindowBits int
+	// ServerMaxWindowBits is used by clients to limit the server's window to 2^n bytes, where n is
+	// between 8 and 15. It is ignored by servers. A second offer without the limit is also sent, so
+	// servers which cannot use a smaller window, including suede servers, still compress.
+	ServerMaxWindowBits int
+}
+
+// permessageDeflate holds the compression state of a single connection once the extension has
+// been negotiated.
+type permessageDeflate struct {
+	level                       int
+	threshold                   int
+	compressNoContextTakeover   bool
+	decompressNoContextTakeover bool
+
+	// maxMessageSize limits the size of decompressed messages, or is zero for no limit.
+	maxMessageSize int64
+
+	compressor     *flate.Writer
+	compressBuffer bytes.Buffer
+	// window holds the most recently decompressed data, which later messages may refer back to
+	// unless the peer resets its context after every message.
+	window []byte
+}
+
+func newPermessageDeflate(options *CompressionOptions, compressNoContextTakeover bool, decompressNoContextTakeover bool) *permessageDeflate {
+	level := options.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	return &permessageDeflate{
+		level:                       level,
+		threshold:                   options.Threshold,
+		compressNoContextTakeover:   compressNoContextTakeover,
+		decompressNoContextTakeover: decompressNoContextTakeover,
+	}
+}
+
+// clientOffer builds the extension offer a client sends in its handshake request.
+func (options *CompressionOptions) clientOffer() ExtensionParams {
+	offer := make(ExtensionParams)
+	if options.ClientNoContextTakeover {
+		offer["client_no_context_takeover"] = ""
+	}
+
+	if options.ServerNoContextTakeover {
+		offer["server_no_context_takeover"] = ""
+	}
+
+	if validWindowBits(options.ServerMaxWindowBits) {
+		offer["server_max_window_bits"] = strconv.Itoa(options.ServerMaxWindowBits)
+	}
+
+	return offer
+}
+
+// clientFallbackOffer builds a second offer without server_max_window_bits, sent after clientOffer
+// so that servers which cannot limit their window, such as suede servers, still accept
+// compression. ok is false if clientOffer asks for no smaller window, so no fallback is needed.
+func (options *CompressionOptions) clientFallbackOffer() (offer ExtensionParams, ok bool) {
+	if !validWindowBits(options.ServerMaxWindowBits) || options.ServerMaxWindowBits == maxWindowBits {
+		return nil, false
+	}
+
+	offer = options.clientOffer()
+	delete(offer, "server_max_window_bits")
+	return offer, true
+}
+
+// clientAccept applies the server's response to the client's offer, failing if the server asked
+// for anything the client cannot do.
+func (options *CompressionOptions) clientAccept(response ExtensionParams) (*permessageDeflate, error) {
+	compressNoContextTakeover := options.ClientNoContextTakeover
+	decompressNoContextTakeover := false
+
+	for name, value := range response {
+		switch name {
+		case "client_no_context_takeover":
+			if value != "" {
+				return nil, &WSClientError{message: "Invalid client_no_context_takeover parameter"}
+			}
+			compressNoContextTakeover = true
+
+		case "server_no_context_takeover":
+			if value != "" {
+				return nil, &WSClientError{message: "Invalid server_no_context_takeover parameter"}
+			}
+			decompressNoContextTakeover = true
+
+		case "server_max_window_bits":
+			bits, parseErr := strconv.Atoi(value)
+			if parseErr != nil || !validWindowBits(bits) {
+				return nil, &WSClientError{message: "Invalid server_max_window_bits parameter"}
+			}
+
+		default:
+			// client_max_window_bits is never offered, so the server must not send it
+			return nil, &WSClientError{message: fmt.Sprintf("Unexpected permessage-deflate parameter %q", name)}
+		}
+	}
+
+	return newPermessageDeflate(options, compressNoContextTakeover, decompressNoContextTakeover), nil
+}
+
+// serverNegotiate responds to a client's offer. If the offer cannot be accepted, ok is false and
+// the client's next offer, if any, should be tried.
+func (options *CompressionOptions) serverNegotiate(offer ExtensionParams) (response ExtensionParams, deflate *permessageDeflate, ok bool) {
+	response = make(ExtensionParams)
+	compressNoContextTakeover := options.ServerNoContextTakeover
+	decompressNoContextTakeover := options.ClientNoContextTakeover
+	clientWindowBitsOffered := false
+	clientWindowBits := maxWindowBits
+
+	for name, value := range offer {
+		switch name {
+		case "server_no_context_takeover":
+			if value != "" {
+				return response, nil, false
+			}
+			compressNoContextTakeover = true
+
+		case "client_no_context_takeover":
+			if value != "" {
+				return response, nil, false
+			}
+			decompressNoContextTakeover = true
+
+		case "server_max_window_bits":
+			bits, parseErr := strconv.Atoi(value)
+			if parseErr != nil || !validWindowBits(bits) {
+				return response, nil, false
+			}
+
+			// compress/flate cannot compress with a window smaller than 32KB
+			if bits < maxWindowBits {
+				return response, nil, false
+			}
+			response["server_max_window_bits"] = value
+
+		case "client_max_window_bits":
+			clientWindowBitsOffered = true
+			if value != "" {
+				bits, parseErr := strconv.Atoi(value)
+				if parseErr != nil || !validWindowBits(bits) {
+					return response, nil, false
+				}
+				clientWindowBits = bits
+			}
+
+		default:
+			return response, nil, false
+		}
+	}
+
+	if compressNoContextTakeover {
+		response["server_no_context_takeover"] = ""
+	}
+
+	if decompressNoContextTakeover {
+		response["client_no_context_takeover"] = ""
+	}
+
+	if clientWindowBitsOffered && validWindowBits(options.ClientMaxWindowBits) {
+		if options.ClientMaxWindowBits < clientWindowBits {
+			clientWindowBits = options.ClientMaxWindowBits
+		}
+		response["client_max_window_bits"] = strconv.Itoa(clientWindowBits)
+	}
+
+	return response, newPermessageDeflate(options, compressNoContextTakeover, decompressNoContextTakeover), true
+}
+
+func validWindowBits(bits int) bool {
+	return bits >= minWindowBits && bits <= maxWindowBits
+}
+
+// shouldCompress reports whether a message of the given length is worth compressing.
+func (deflate *permessageDeflate) shouldCompress(length int) bool {
+	return length >= deflate.threshold
+}
+
+// compress compresses a whole message payload. Calls must not be made concurrently.
+func (deflate *permessageDeflate) compress(data []byte) ([]byte, error) {
+	deflate.compressBuffer.Reset()
+
+	if deflate.compressor == nil {
+		compressor, writerErr := flate.NewWriter(&deflate.compressBuffer, deflate.level)
+		if writerErr != nil {
+			return nil, writerErr
+		}
+		deflate.compressor = compressor
+	} else if deflate.compressNoContextTakeover {
+		deflate.compressor.Reset(&deflate.compressBuffer)
+	}
+
+	if _, writeErr := deflate.compressor.Write(data); writeErr != nil {
+		return nil, writeErr
+	}
+
+	if flushErr := deflate.compressor.Flush(); flushErr != nil {
+		return nil, flushErr
+	}
+
+	compressed := bytes.TrimSuffix(deflate.compressBuffer.Bytes(), deflateTail)
+	if len(compressed) == 0 {
+		// an empty message is sent as a single empty block (RFC 7692 section 7.2.3.6)
+		return []byte{0x00}, nil
+	}
+
+	return append([]byte(nil), compressed...), nil
+}
+
+// decompress restores a compressed message payload. Calls must not be made concurrently.
+func (deflate *permessageDeflate) decompress(data []byte) ([]byte, error) {
+	input := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail), bytes.NewReader(deflateFinalBlock))
+
+	var reader io.ReadCloser
+	if deflate.decompressNoContextTakeover {
+		reader = flate.NewReader(input)
+	} else {
+		reader = flate.NewReaderDict(input, deflate.window)
+	}
+	defer reader.Close()
+
+	var limited io.Reader = reader
+	if deflate.maxMessageSize > 0 {
+		limited = io.LimitReader(reader, deflate.maxMessageSize+1)
+	}
+
+	decompressed, readErr := io.ReadAll(limited)
+	if readErr != nil {
+		return nil, &WSFrameError{message: "Invalid compressed message", code: CloseInvalidPayload}
+	}
+
+	if deflate.maxMessageSize > 0 && int64(len(decompressed)) > deflate.maxMessageSize {
+		return nil, messageTooBig(deflate.maxMessageSize)
+	}
+
+	if !deflate.decompressNoContextTakeover {
+		deflate.window = append(deflate.window, decompressed...)
+		if len(deflate.window) > deflateWindowSize {
+			deflate.window = append([]byte(nil), deflate.window[len(deflate.window)-deflateWindowSize:]...)
+		}
+	}
+
+	return decompressed, nil
+}
+
+// deflateExtension adapts permessage-deflate to the Extension interface, so that it is negotiated
+// and applied like any other extension.
+type deflateExtension struct {
+	options *CompressionOptions
+	deflate *permessageDeflate
+}
+
+func (extension *deflateExtension) Name() string {
+	return deflateExtensionName
+}
+
+func (extension *deflateExtension) ReservedBits() byte {
+	return ReservedBit1
+}
+
+func (extension *deflateExtension) Offer() ExtensionParams {
+	return extension.options.clientOffer()
+}
+
+func (extension *deflateExtension) Accept(response ExtensionParams) error {
+	deflate, acceptErr := extension.options.clientAccept(response)
+	if acceptErr != nil {
+		return acceptErr
+	}
+
+	extension.deflate = deflate
+	return nil
+}
+
+func (extension *deflateExtension) Negotiate(offer ExtensionParams) (ExtensionParams, bool) {
+	response, deflate, ok := extension.options.serverNegotiate(offer)
+	if !ok {
+		return nil, false
+	}
+
+	extension.deflate = deflate
+	return response, true
+}
+
+// limitMessageSize caps the size of decompressed messages, so that a small compressed message
+// cannot expand without bound.
+func (extension *deflateExtension) limitMessageSize(maxMessageSize int64) {
+	extension.deflate.maxMessageSize = maxMessageSize
+}
+
+func (extension *deflateExtension) EncodeMessage(message *Frame) error {
+	if !extension.deflate.shouldCompress(len(message.Payload)) {
+		return nil
+	}
+
+	compressed, compressErr := extension.deflate.compress(message.Payload)
+	if compressErr != nil {
+		return compressErr
+	}
+
+	message.Payload = compressed
+	message.Rsv1 = true
+	return nil
+}
+
+func (extension *deflateExtension) DecodeMessage(message *Frame) error {
+	if !message.Rsv1 {
+		return nil
+	}
+
+	decompressed, decompressErr := extension.deflate.decompress(message.Payload)
+	if decompressErr != nil {
+		return decompressErr
+	}
+
+	message.Payload = decompressed
+	message.Rsv1 = false
+	return nil
+}
@@ -0,0 +1,541 @@
+package suede
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// closeTimeout is how long to wait for the peer to reply to a close frame before the network
+// connection is closed regardless.
+const closeTimeout = 5 * time.Second
+
+// connectionIDs is the last ID assigned to a connection.
+var connectionIDs uint64
+
+// ErrConnectionClosed is returned when sending a message after the closing handshake has started.
+var ErrConnectionClosed = errors.New("WebSocket connection is closed")
+
+// WSConnection is a single WebSocket connection. The server passes one to every callback, where
+// it can be used to reply to, or close, the client that triggered the callback.
+type WSConnection struct {
+	// Data is a slot for application state associated with the connection, such as a username or
+	// session. It is never read or modified by suede.
+	Data any
+
+	id            uint64
+	conn          net.Conn
+	frameWriter   *FrameWriter
+	messageReader *messageReader
+	request       *http.Request
+	subprotocol   string
+	identity      any
+	extensions    []Extension
+	// frameExtensions holds the extensions which also encode each outgoing data frame.
+	frameExtensions []FrameExtension
+	// maxMessageSize is the largest message accepted once decoded, or zero for no limit.
+	maxMessageSize int64
+	// onError, if set, is told about every error which fails the connection.
+	onError func(error)
+	// writeTimeout limits how long each frame may take to write, or zero for no limit.
+	// writeTimeoutErr is set once a write has timed out.
+	writeTimeout    time.Duration
+	writeTimeoutErr atomic.Pointer[WSTimeoutError]
+
+	// writeMutex serializes every frame written to the connection, while messageSlot keeps the
+	// fragments of one data message from interleaving with those of another. messageSlot is a
+	// semaphore holding one token while a message is sent, so that senders can stop waiting for it.
+	// Control frames only take writeMutex, so they may be sent between the fragments of a message.
+	writeMutex  sync.Mutex
+	messageSlot chan struct{}
+	// closeWritten is set, under writeMutex, once a close frame has been written. No data frame may
+	// follow it, so a message still being sent is abandoned.
+	closeWritten bool
+
+	// closeMutex also guards keepalive. dropStatus, if set, is reported in place of
+	// CloseAbnormalClosure once the read loop stops, because the connection was dropped locally.
+	closeMutex sync.Mutex
+	closeSent  bool
+	closeTimer *time.Timer
+	dropStatus *WSCloseError
+	keepalive  keepaliveState
+}
+
+// newWSConnection wraps an upgraded network connection. reader must be used for all reads, as it
+// may already hold frames buffered during the handshake. Client connections mask the frames they
+// send, and expect the frames they receive to be unmasked.
+func newWSConnection(id uint64, conn net.Conn, reader *bufio.Reader, request *http.Request, isClient bool) *WSConnection {
+	connection := &WSConnection{
+		id:          id,
+		conn:        conn,
+		frameWriter: NewFrameWriter(conn, isClient),
+		request:     request,
+		messageSlot: make(chan struct{}, 1),
+	}
+
+	connection.messageReader = newMessageReader(NewFrameReader(reader), !isClient, connection.handleControlFrame)
+	return connection
+}
+
+// ID returns an identifier for the connection, unique within the process.
+func (connection *WSConnection) ID() uint64 {
+	return connection.id
+}
+
+// RemoteAddr returns the network address of the client.
+func (connection *WSConnection) RemoteAddr() net.Addr {
+	return connection.conn.RemoteAddr()
+}
+
+// Header returns the headers of the HTTP request which opened the connection.
+func (connection *WSConnection) Header() http.Header {
+	return connection.request.Header
+}
+
+// Path returns the URL path of the HTTP request which opened the connection.
+func (connection *WSConnection) Path() string {
+	return connection.request.URL.Path
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, or an empty string if
+// none was agreed.
+func (connection *WSConnection) Subprotocol() string {
+	return connection.subprotocol
+}
+
+// Identity returns the identity returned by the server's Authenticate hook when the connection was
+// accepted, or nil if the server does not authenticate clients.
+func (connection *WSConnection) Identity() any {
+	return connection.identity
+}
+
+// Send writes data to the client as a text message. It is safe to send from multiple goroutines
+// at once.
+func (connection *WSConnection) Send(data []byte) error {
+	return connection.SendText(data)
+}
+
+// SendText writes data to the client as a text message.
+func (connection *WSConnection) SendText(data []byte) error {
+	return connection.SendMessage(TextMessage, data)
+}
+
+// SendBinary writes data to the client as a binary message.
+func (connection *WSConnection) SendBinary(data []byte) error {
+	return connection.SendMessage(BinaryMessage, data)
+}
+
+// SendMessage writes data to the client as a single message of the given type.
+func (connection *WSConnection) SendMessage(messageType MessageType, data []byte) error {
+	return connection.send(context.Background(), messageType, data, 0)
+}
+
+// SendFragmented writes data to the client as one message of the given type, split across
+// multiple frames each carrying at most fragmentSize bytes. If the connection is closed before
+// every fragment is sent, the rest are dropped and ErrConnectionClosed is returned.
+func (connection *WSConnection) SendFragmented(messageType MessageType, data []byte, fragmentSize int) error {
+	if sizeErr := checkFragmentSize(fragmentSize); sizeErr != nil {
+		return sizeErr
+	}
+
+	return connection.send(context.Background(), messageType, data, fragmentSize)
+}
+
+// SendContext writes data to the peer as a single message of the given type, giving up once ctx
+// is done. A message abandoned part way through being written leaves the connection unusable, so
+// the connection is then closed.
+func (connection *WSConnection) SendContext(ctx context.Context, messageType MessageType, data []byte) error {
+	return connection.send(ctx, messageType, data, 0)
+}
+
+// send writes data as one message, split into frames of at most fragmentSize bytes if
+// fragmentSize is positive. It waits for any message already being sent, returning ctx.Err()
+// without touching the connection if ctx is done first. Once its own frames are being written,
+// ctx interrupts them, and as the message is left incomplete the network connection is closed.
+func (connection *WSConnection) send(ctx context.Context, messageType MessageType, data []byte, fragmentSize int) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	select {
+	case connection.messageSlot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-connection.messageSlot }()
+
+	if connection.isClosing() {
+		return ErrConnectionClosed
+	}
+
+	message, encodeErr := connection.encodeMessage(messageType, data)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	writer := &messageWriter{connection: connection}
+	stopInterrupt := interruptOnDone(ctx, writer.interrupt)
+
+	var sendErr error
+	if fragmentSize > 0 {
+		sendErr = writeFragmented(writer.writeFrame, message, fragmentSize)
+	} else {
+		sendErr = writer.writeFrame(message)
+	}
+
+	if !stopInterrupt() {
+		return sendErr
+	}
+
+	if sendErr == nil {
+		// ctx was done only once the message had been written
+		connection.conn.SetWriteDeadline(time.Time{})
+		return nil
+	}
+
+	connection.conn.Close()
+	return ctx.Err()
+}
+
+// encodeMessage builds the frame for an outgoing data message, encoded by every negotiated
+// extension. It must be called while holding messageSlot.
+func (connection *WSConnection) encodeMessage(messageType MessageType, data []byte) (*Frame, error) {
+	if !messageType.valid() {
+		return nil, &WSFrameError{message: fmt.Sprintf("Invalid message type %s", messageType)}
+	}
+
+	message := &Frame{
+		Fin:     true,
+		OpCode:  byte(messageType),
+		Payload: data,
+	}
+
+	for _, extension := range connection.extensions {
+		if encodeErr := extension.EncodeMessage(message); encodeErr != nil {
+			return nil, encodeErr
+		}
+	}
+
+	return message, nil
+}
+
+// Close starts the closing handshake by sending a close frame with the given status code and
+// reason, which must be at most 123 bytes. Close returns once the frame is sent; the network
+// connection is closed when the peer replies, or after five seconds if it never does, even if the
+// frame is still waiting to be sent.
+func (connection *WSConnection) Close(code CloseCode, reason string) error {
+	payload, encodeErr := encodeClosePayload(code, reason)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	if !connection.startClosing() {
+		return nil
+	}
+
+	// the timer starts before the write, which may wait behind a frame the peer is not reading,
+	// so that it also limits how long the close frame can take to send
+	connection.closeMutex.Lock()
+	connection.closeTimer = time.AfterFunc(closeTimeout, func() {
+		connection.conn.Close()
+	})
+	connection.closeMutex.Unlock()
+
+	writeErr := connection.writeFrame(&Frame{Fin: true, OpCode: OpClose, Payload: payload})
+	if writeErr != nil {
+		connection.conn.Close()
+		return writeErr
+	}
+
+	return nil
+}
+
+// startClosing marks the closing handshake as started, returning false if it already had been.
+// The close frame is then written without holding closeMutex, as the write may wait behind a frame
+// the peer is slow to accept, and closeMutex is also taken by every send and by the read loop.
+func (connection *WSConnection) startClosing() bool {
+	connection.closeMutex.Lock()
+	defer connection.closeMutex.Unlock()
+
+	if connection.closeSent {
+		return false
+	}
+
+	connection.closeSent = true
+	return true
+}
+
+// writeFrame writes a single frame, serialized with every other write to the connection.
+func (connection *WSConnection) writeFrame(frame *Frame) error {
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+
+	return connection.writeFrameLocked(frame, nil)
+}
+
+// messageWriter writes the frames of one data message. interrupted is set once the message's
+// context interrupts its writes, and belongs to this message alone.
+type messageWriter struct {
+	connection  *WSConnection
+	interrupted atomic.Bool
+}
+
+// interrupt sets deadline, which has already passed, on the connection's writes.
+func (writer *messageWriter) interrupt(deadline time.Time) error {
+	writer.interrupted.Store(true)
+	return writer.connection.conn.SetWriteDeadline(deadline)
+}
+
+// writeFrame encodes a frame of the message with any frame extensions, then writes it unless the
+// closing handshake has started, in which case ErrConnectionClosed is returned.
+func (writer *messageWriter) writeFrame(frame *Frame) error {
+	connection := writer.connection
+	for _, extension := range connection.frameExtensions {
+		if encodeErr := extension.EncodeFrame(frame); encodeErr != nil {
+			return encodeErr
+		}
+	}
+
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+
+	if connection.closeWritten {
+		return ErrConnectionClosed
+	}
+
+	return connection.writeFrameLocked(frame, &writer.interrupted)
+}
+
+// writeFrameLocked writes frame while holding writeMutex. interrupted, if set, belongs to the data
+// message the frame is part of.
+func (connection *WSConnection) writeFrameLocked(frame *Frame, interrupted *atomic.Bool) error {
+	if frame.OpCode == OpClose {
+		connection.closeWritten = true
+	}
+
+	deadline := connection.setWriteDeadline(interrupted)
+	writeErr := connection.frameWriter.WriteFrame(frame)
+	// an interrupting context sets an earlier deadline, which is not a write timeout
+	if !deadline.IsZero() && errors.Is(writeErr, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+		return connection.writeTimedOut()
+	}
+
+	return writeErr
+}
+
+func (connection *WSConnection) isClosing() bool {
+	connection.closeMutex.Lock()
+	defer connection.closeMutex.Unlock()
+
+	return connection.closeSent
+}
+
+// ReadMessage reads the next complete data message from the peer. It is only needed for
+// connections returned by Upgrade; connections accepted by a server are read by the server, and
+// must not be read directly. Once the connection closes, ReadMessage returns a *WSCloseError
+// describing why.
+func (connection *WSConnection) ReadMessage() (MessageType, []byte, error) {
+	messageType, data, readErr := connection.readMessage()
+	if readErr != nil {
+		return 0, nil, connection.finishRead(readErr)
+	}
+
+	return messageType, data, nil
+}
+
+// readMessage reads the next complete data message, answering any control frames which arrive
+// in the meantime.
+func (connection *WSConnection) readMessage() (MessageType, []byte, error) {
+	message, readErr := connection.messageReader.readMessage()
+	if readErr != nil {
+		return 0, nil, readErr
+	}
+
+	for index := len(connection.extensions) - 1; index >= 0; index-- {
+		if decodeErr := connection.extensions[index].DecodeMessage(message); decodeErr != nil {
+			return 0, nil, decodeError(decodeErr)
+		}
+	}
+
+	data := message.Payload
+	if connection.maxMessageSize > 0 && int64(len(data)) > connection.maxMessageSize {
+		return 0, nil, messageTooBig(connection.maxMessageSize)
+	}
+
+	if message.OpCode == OpText && !utf8.Valid(data) {
+		return 0, nil, &WSFrameError{message: "Text message is not valid UTF-8", code: CloseInvalidPayload}
+	}
+
+	return MessageType(message.OpCode), data, nil
+}
+
+// useExtensions enables the extensions negotiated during the handshake, allowing incoming
+// messages to use their reserved bits.
+func (connection *WSConnection) useExtensions(extensions []Extension) {
+	connection.extensions = extensions
+	connection.frameExtensions = frameExtensions(extensions)
+	connection.messageReader.frameExtensions = connection.frameExtensions
+	for _, extension := range extensions {
+		connection.messageReader.allowedRsv |= extension.ReservedBits()
+	}
+}
+
+// setSizeLimits limits the size of incoming frames and messages, where zero means no limit. A
+// frame can never be larger than the message it belongs to, so the message limit also caps
+// frames. Extensions must already be in use, so that decompression can be capped too.
+func (connection *WSConnection) setSizeLimits(maxFrameSize int64, maxMessageSize int64) {
+	if maxMessageSize > 0 && (maxFrameSize <= 0 || maxFrameSize > maxMessageSize) {
+		maxFrameSize = maxMessageSize
+	}
+
+	connection.maxMessageSize = maxMessageSize
+	connection.messageReader.frameReader.maxFrameSize = maxFrameSize
+	connection.messageReader.maxMessageSize = maxMessageSize
+
+	for _, extension := range connection.extensions {
+		if limiter, ok := extension.(interface{ limitMessageSize(int64) }); ok {
+			limiter.limitMessageSize(maxMessageSize)
+		}
+	}
+}
+
+func (connection *WSConnection) handleControlFrame(frame *Frame) error {
+	switch frame.OpCode {
+	case OpClose:
+		return connection.receiveClose(frame)
+
+	case OpPing:
+		connection.receivePing(frame.Payload)
+
+	case OpPong:
+		connection.receivePong(frame.Payload)
+	}
+
+	return nil
+}
+
+// receiveClose handles a close frame from the peer, echoing its status code if the close was
+// initiated by the peer. The returned error stops the read loop.
+func (connection *WSConnection) receiveClose(frame *Frame) error {
+	closeStatus, decodeErr := decodeClosePayload(frame.Payload)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	if connection.startClosing() {
+		payload, _ := encodeClosePayload(closeStatus.Code, "")
+		connection.writeFrame(&Frame{Fin: true, OpCode: OpClose, Payload: payload})
+	}
+
+	return closeStatus
+}
+
+// finishRead is called once a read loop stops with readErr. If the peer broke the protocol the
+// connection is failed with an appropriate close status. The network connection is then closed,
+// and the status to report to the application is returned.
+func (connection *WSConnection) finishRead(readErr error) *WSCloseError {
+	defer connection.conn.Close()
+
+	connection.closeMutex.Lock()
+	if connection.closeTimer != nil {
+		connection.closeTimer.Stop()
+	}
+	connection.stopKeepalive()
+	dropStatus := connection.dropStatus
+	connection.closeMutex.Unlock()
+
+	var closeErr *WSCloseError
+	if errors.As(readErr, &closeErr) {
+		return closeErr
+	}
+
+	if dropStatus != nil {
+		return dropStatus
+	}
+
+	if timeoutErr := connection.writeTimeoutErr.Load(); timeoutErr != nil {
+		if connection.onError != nil {
+			connection.onError(timeoutErr)
+		}
+		return &WSCloseError{Code: CloseAbnormalClosure, Reason: timeoutErr.reason()}
+	}
+
+	if readTimeout := connection.messageReader.readTimeout; readTimeout > 0 && errors.Is(readErr, os.ErrDeadlineExceeded) {
+		timeoutErr := &WSTimeoutError{Op: "read", Duration: readTimeout}
+		if connection.onError != nil {
+			connection.onError(timeoutErr)
+		}
+		connection.drop(CloseGoingAway, timeoutErr.reason())
+		return &WSCloseError{Code: CloseAbnormalClosure, Reason: timeoutErr.reason()}
+	}
+
+	var frameErr *WSFrameError
+	if errors.As(readErr, &frameErr) {
+		if connection.onError != nil {
+			connection.onError(frameErr)
+		}
+		connection.fail(frameErr.closeCode(), frameErr.Error())
+		return &WSCloseError{Code: frameErr.closeCode(), Reason: frameErr.Error()}
+	}
+
+	if readErr != io.EOF && !errors.Is(readErr, net.ErrClosed) {
+		if connection.onError != nil {
+			connection.onError(readErr)
+		}
+	}
+
+	return &WSCloseError{Code: CloseAbnormalClosure}
+}
+
+// fail sends a close frame without waiting for the peer to reply, as required when the connection
+// must be dropped because of an error.
+func (connection *WSConnection) fail(code CloseCode, reason string) {
+	if !connection.startClosing() {
+		return
+	}
+
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+
+	payload, encodeErr := encodeClosePayload(code, reason)
+	if encodeErr == nil {
+		connection.writeFrame(&Frame{Fin: true, OpCode: OpClose, Payload: payload})
+	}
+}
+
+// drop closes a connection whose peer has stopped responding. A close frame is still sent, but
+// the network connection is closed straight away, and the read loop reports CloseAbnormalClosure
+// with the given reason. Keepalive is stopped too, as a connection dropped before it went online
+// has no read loop to stop it.
+func (connection *WSConnection) drop(code CloseCode, reason string) {
+	connection.closeMutex.Lock()
+	connection.dropStatus = &WSCloseError{Code: CloseAbnormalClosure, Reason: reason}
+	connection.stopKeepalive()
+	connection.closeMutex.Unlock()
+
+	connection.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	connection.fail(code, reason)
+	connection.conn.Close()
+}
+
+// Ping sends a ping carrying payload, which must be at most 125 bytes. The peer echoes the payload
+// in its pong, so it can carry data such as a timestamp.
+func (connection *WSConnection) Ping(payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return &WSFrameError{message: "Ping payload exceeds 125 bytes"}
+	}
+
+	connection.pingSent()
+	return connection.writeFrame(&Frame{Fin: true, OpCode: OpPing, Payload: payload})
+}
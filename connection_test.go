@@ -0,0 +1,360 @@
+package suede
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// testServer is a server which echoes every message back to the client, and records the messages,
+// errors and close statuses it sees.
+type testServer struct {
+	*wsserver
+	httpServer  *httptest.Server
+	messages    chan []byte
+	errors      chan error
+	disconnects chan CloseCode
+}
+
+func newTestServer(t *testing.T, configure func(*wsserver)) *testServer {
+	wsServer, _ := WebSocketHandler()
+	server := &testServer{
+		wsserver:    wsServer,
+		messages:    make(chan []byte, 16),
+		errors:      make(chan error, 16),
+		disconnects: make(chan CloseCode, 16),
+	}
+
+	wsServer.OnTypedMessage = func(connection *WSConnection, messageType MessageType, data []byte) {
+		server.messages <- data
+		connection.SendMessage(messageType, data)
+	}
+	wsServer.OnError = func(connection *WSConnection, err error) {
+		server.errors <- err
+	}
+	wsServer.OnDisconnect = func(connection *WSConnection, code CloseCode, reason string) {
+		server.disconnects <- code
+	}
+	if configure != nil {
+		configure(wsServer)
+	}
+
+	server.httpServer = httptest.NewServer(wsServer)
+	t.Cleanup(server.httpServer.Close)
+	return server
+}
+
+// testClient is a client connected to a testServer, recording the messages and close status it
+// receives.
+type testClient struct {
+	*wsclient
+	messages    chan []byte
+	disconnects chan CloseCode
+}
+
+func newTestClient(t *testing.T, server *testServer, configure func(*wsclient)) *testClient {
+	wsClient, _ := WebSocket(server.httpServer.URL)
+	client := &testClient{
+		wsclient:    wsClient,
+		messages:    make(chan []byte, 16),
+		disconnects: make(chan CloseCode, 1),
+	}
+
+	wsClient.OnMessage = func(data []byte) {
+		client.messages <- data
+	}
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		client.disconnects <- code
+	}
+	if configure != nil {
+		configure(wsClient)
+	}
+
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	t.Cleanup(func() {
+		wsClient.Close(CloseNormalClosure, "")
+		wg.Wait()
+	})
+
+	return client
+}
+
+func receive[T any](t *testing.T, values <-chan T, what string) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+		panic("unreachable")
+	}
+}
+
+func TestFragmentedRoundTrip(t *testing.T) {
+	server := newTestServer(t, nil)
+	client := newTestClient(t, server, nil)
+
+	data := []byte(strings.Repeat("fragmented ", 100))
+	client.SendFragmented(TextMessage, data, 64)
+
+	if received := receive(t, server.messages, "server message"); !bytes.Equal(received, data) {
+		t.Errorf("server received %d bytes, want %d", len(received), len(data))
+	}
+
+	if echoed := receive(t, client.messages, "echoed message"); !bytes.Equal(echoed, data) {
+		t.Errorf("client received %d bytes, want %d", len(echoed), len(data))
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.Compression = &CompressionOptions{}
+	})
+	client := newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.Compression = &CompressionOptions{}
+	})
+
+	negotiated := client.ResponseHeader().Get("Sec-WebSocket-Extensions")
+	if !strings.HasPrefix(negotiated, "permessage-deflate") {
+		t.Fatalf("negotiated extensions %q, want permessage-deflate", negotiated)
+	}
+
+	// several messages, so that context takeover is exercised as well
+	for _, data := range [][]byte{
+		[]byte(strings.Repeat("compress me ", 500)),
+		[]byte(strings.Repeat("compress me ", 500)),
+		[]byte("x"),
+	} {
+		client.SendFragmented(TextMessage, data, 10)
+
+		if received := receive(t, server.messages, "server message"); !bytes.Equal(received, data) {
+			t.Errorf("server received %q, want %d bytes", received, len(data))
+		}
+
+		if echoed := receive(t, client.messages, "echoed message"); !bytes.Equal(echoed, data) {
+			t.Errorf("client received %q, want %d bytes", echoed, len(data))
+		}
+	}
+}
+
+func TestDeflateServerWindowFallback(t *testing.T) {
+	offers := make(chan string, 1)
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.Compression = &CompressionOptions{}
+		wsServer.Authenticate = func(req *http.Request) (any, error) {
+			offers <- req.Header.Get("Sec-WebSocket-Extensions")
+			return nil, nil
+		}
+	})
+	client := newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.Compression = &CompressionOptions{ServerMaxWindowBits: 10}
+	})
+
+	wantOffers := "permessage-deflate; server_max_window_bits=10, permessage-deflate"
+	if offered := receive(t, offers, "extension offers"); offered != wantOffers {
+		t.Errorf("client offered %q, want %q", offered, wantOffers)
+	}
+
+	// the server cannot compress with a smaller window, so it accepts the fallback offer
+	if negotiated := client.ResponseHeader().Get("Sec-WebSocket-Extensions"); negotiated != "permessage-deflate" {
+		t.Fatalf("negotiated extensions %q, want permessage-deflate", negotiated)
+	}
+
+	data := []byte(strings.Repeat("compress me ", 500))
+	client.SendText(data)
+	if echoed := receive(t, client.messages, "echoed message"); !bytes.Equal(echoed, data) {
+		t.Errorf("client received %d bytes, want %d", len(echoed), len(data))
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression bool
+		send        func(client *testClient)
+	}{
+		{"frame too big", false, func(client *testClient) {
+			client.SendBinary(make([]byte, 600))
+		}},
+		{"fragmented message too big", false, func(client *testClient) {
+			client.SendFragmented(BinaryMessage, make([]byte, 1200), 400)
+		}},
+		{"decompressed message too big", true, func(client *testClient) {
+			client.SendBinary(make([]byte, 100000))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, func(wsServer *wsserver) {
+				wsServer.MaxFrameSize = 500
+				wsServer.MaxMessageSize = 1000
+				if test.compression {
+					wsServer.Compression = &CompressionOptions{}
+				}
+			})
+			client := newTestClient(t, server, func(wsClient *wsclient) {
+				if test.compression {
+					wsClient.Compression = &CompressionOptions{}
+				}
+			})
+
+			// a message within the limits is accepted
+			client.SendFragmented(BinaryMessage, make([]byte, 900), 400)
+			receive(t, server.messages, "message within limits")
+
+			test.send(client)
+
+			var frameErr *WSFrameError
+			if err := receive(t, server.errors, "server error"); !errors.As(err, &frameErr) || frameErr.closeCode() != CloseMessageTooBig {
+				t.Errorf("server error %v, want a *WSFrameError with CloseMessageTooBig", err)
+			}
+
+			if code := receive(t, client.disconnects, "client disconnect"); code != CloseMessageTooBig {
+				t.Errorf("client disconnected with %d, want %d", code, CloseMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestCloseStopsFragmentedMessage(t *testing.T) {
+	type result struct {
+		closeIndex     int
+		framesAfter    int
+		framesReceived int
+	}
+	results := make(chan result, 1)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, upgradeErr := Upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+		defer connection.conn.Close()
+
+		// hold up the client so that its message is still being sent when it closes
+		time.Sleep(100 * time.Millisecond)
+		outcome := result{closeIndex: -1}
+		for true {
+			frame, readErr := connection.messageReader.frameReader.ReadFrame()
+			if readErr != nil {
+				break
+			}
+
+			if frame.OpCode == OpClose {
+				outcome.closeIndex = outcome.framesReceived
+				connection.conn.Close()
+			} else if outcome.closeIndex >= 0 {
+				outcome.framesAfter++
+			}
+			outcome.framesReceived++
+		}
+		results <- outcome
+	}))
+	defer httpServer.Close()
+
+	wsClient, _ := WebSocket(httpServer.URL)
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	connection := wsClient.currentConnection()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- connection.SendFragmented(BinaryMessage, make([]byte, 32<<20), 1<<16)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	connection.Close(CloseNormalClosure, "")
+
+	if sendErr := receive(t, sent, "SendFragmented"); sendErr != ErrConnectionClosed {
+		t.Errorf("SendFragmented returned %v, want ErrConnectionClosed", sendErr)
+	}
+
+	outcome := receive(t, results, "server frames")
+	if outcome.closeIndex < 0 {
+		t.Fatalf("server never received the close frame")
+	}
+	if outcome.framesAfter != 0 {
+		t.Errorf("server received %d frames after the close frame", outcome.framesAfter)
+	}
+	wg.Wait()
+}
+
+func TestSendContextWaitingForAnotherMessage(t *testing.T) {
+	messages := make(chan int, 4)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, upgradeErr := Upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+
+		// hold up the client's first send until it is waiting behind it
+		time.Sleep(300 * time.Millisecond)
+		for true {
+			_, data, readErr := connection.ReadMessage()
+			if readErr != nil {
+				return
+			}
+			messages <- len(data)
+		}
+	}))
+	defer httpServer.Close()
+
+	wsClient, _ := WebSocket(httpServer.URL)
+	disconnects := make(chan CloseCode, 1)
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		disconnects <- code
+	}
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	connection := wsClient.currentConnection()
+
+	const bigMessage = 16 << 20
+	bigSent := make(chan error, 1)
+	go func() {
+		bigSent <- connection.SendBinary(make([]byte, bigMessage))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if sendErr := connection.SendContext(ctx, TextMessage, []byte("late")); sendErr != context.DeadlineExceeded {
+		t.Errorf("SendContext returned %v, want context.DeadlineExceeded", sendErr)
+	}
+
+	if sendErr := receive(t, bigSent, "first send"); sendErr != nil {
+		t.Fatalf("first send failed: %s", sendErr)
+	}
+
+	if length := receive(t, messages, "first message"); length != bigMessage {
+		t.Errorf("server received %d bytes, want %d", length, bigMessage)
+	}
+
+	if sendErr := connection.SendText([]byte("after")); sendErr != nil {
+		t.Fatalf("SendText after the abandoned send: %s", sendErr)
+	}
+	if length := receive(t, messages, "second message"); length != len("after") {
+		t.Errorf("server received %d bytes, want %d", length, len("after"))
+	}
+
+	wsClient.Close(CloseNormalClosure, "")
+	if code := receive(t, disconnects, "client disconnect"); code != CloseNormalClosure {
+		t.Errorf("client disconnected with %d, want %d", code, CloseNormalClosure)
+	}
+	wg.Wait()
+}
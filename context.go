@@ -0,0 +1,35 @@
+package suede
+
+import (
+	"context"
+	"time"
+)
+
+// pastDeadline is a deadline which has already passed, used to interrupt blocked reads and writes.
+var pastDeadline = time.Unix(1, 0)
+
+// interruptOnDone watches ctx while a blocking operation runs on a connection. Once ctx is done,
+// setDeadline is called with a deadline in the past, making any blocked read or write fail. The
+// returned stop function ends the watch, and reports whether ctx interrupted the operation.
+func interruptOnDone(ctx context.Context, setDeadline func(time.Time) error) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(pastDeadline)
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
+}
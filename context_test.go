@@ -0,0 +1,122 @@
+package suede
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunContextCancel(t *testing.T) {
+	server := newTestServer(t, nil)
+	wsClient, _ := WebSocket(server.httpServer.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connected := make(chan struct{}, 1)
+	wsClient.OnConnect = func() {
+		connected <- struct{}{}
+	}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- wsClient.RunContext(ctx)
+	}()
+
+	receive(t, connected, "connection")
+	cancel()
+
+	if runErr := receive(t, ran, "RunContext"); runErr != context.Canceled {
+		t.Errorf("RunContext returned %v, want context.Canceled", runErr)
+	}
+	if code := receive(t, server.disconnects, "server disconnect"); code != CloseGoingAway {
+		t.Errorf("server saw the client disconnect with %d, want %d", code, CloseGoingAway)
+	}
+}
+
+func TestSendContextInterruptedMidWrite(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, upgradeErr := Upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+		defer connection.conn.Close()
+
+		// never read, so that the client's message is still being written when ctx is done
+		<-release
+	}))
+	defer httpServer.Close()
+
+	wsClient, _ := WebSocket(httpServer.URL)
+	disconnects := make(chan CloseCode, 1)
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		disconnects <- code
+	}
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	defer wg.Wait()
+	connection := wsClient.currentConnection()
+	defer connection.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- wsClient.SendContext(ctx, BinaryMessage, make([]byte, 16<<20))
+	}()
+
+	if sendErr := receive(t, sent, "SendContext"); sendErr != context.DeadlineExceeded {
+		t.Errorf("SendContext returned %v, want context.DeadlineExceeded", sendErr)
+	}
+
+	// the message was left incomplete, so the connection is closed
+	if code := receive(t, disconnects, "client disconnect"); code != CloseAbnormalClosure {
+		t.Errorf("client disconnected with %d, want %d", code, CloseAbnormalClosure)
+	}
+	if sendErr := connection.SendText([]byte("after")); sendErr == nil {
+		t.Errorf("SendText succeeded on the closed connection")
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	wsServer, _ := WebSocketServer(freePort(t), "/ws")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	startServer(t, wsServer, func() {
+		go func() {
+			served <- wsServer.Serve(ctx)
+		}()
+	})
+
+	wsClient, _ := WebSocket(fmt.Sprintf("ws://127.0.0.1:%d/ws", wsServer.Host))
+	disconnects := make(chan CloseCode, 1)
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		disconnects <- code
+	}
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	defer wg.Wait()
+
+	cancel()
+
+	if serveErr := receive(t, served, "Serve"); serveErr != context.Canceled {
+		t.Errorf("Serve returned %v, want context.Canceled", serveErr)
+	}
+	if code := receive(t, disconnects, "client disconnect"); code != CloseGoingAway {
+		t.Errorf("client disconnected with %d, want %d", code, CloseGoingAway)
+	}
+	if wsServer.IsActive() {
+		t.Errorf("IsActive reported true once Serve returned")
+	}
+}
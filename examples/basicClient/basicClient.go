@@ -19,8 +19,8 @@ func main() {
 		wsClient.Send([]byte("Hello I am a new client"))
 	}
 
-	wsClient.OnDisconnect = func() {
-		fmt.Println("Disconnect callback")
+	wsClient.OnDisconnect = func(code suede.CloseCode, reason string) {
+		fmt.Printf("Disconnected with status %d: %s\n", code, reason)
 	}
 
 	wsClient.OnMessage = func(data []byte) {
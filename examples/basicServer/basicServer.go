@@ -13,16 +13,17 @@ func main() {
 		panic("Could not create WebSocket server")
 	}
 
-	wsServer.OnConnect = func() {
-		fmt.Println("Client connected")
+	wsServer.OnConnect = func(connection *suede.WSConnection) {
+		fmt.Printf("Client %d connected from %s\n", connection.ID(), connection.RemoteAddr())
 	}
 
-	wsServer.OnDisconnect = func() {
-		fmt.Println("Client disconnected")
+	wsServer.OnDisconnect = func(connection *suede.WSConnection, code suede.CloseCode, reason string) {
+		fmt.Printf("Client %d disconnected with status %d: %s\n", connection.ID(), code, reason)
 	}
 
-	wsServer.OnMessage = func(data []byte) {
-		fmt.Printf("Message = %s\n", data)
+	wsServer.OnMessage = func(connection *suede.WSConnection, data []byte) {
+		fmt.Printf("Message from client %d = %s\n", connection.ID(), data)
+		connection.Send([]byte("message received"))
 		wsServer.Broadcast([]byte("broadcasting..."))
 	}
 
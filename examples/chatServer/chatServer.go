@@ -12,15 +12,16 @@ func main() {
 		panic("could not start server")
 	}
 
-	server.OnConnect = func() {
-		server.Broadcast([]byte("New user joined the chat!"))
+	server.OnConnect = func(connection *suede.WSConnection) {
+		connection.Send([]byte(fmt.Sprintf("Welcome! You are user %d", connection.ID())))
+		server.Broadcast([]byte(fmt.Sprintf("User %d joined the chat!", connection.ID())))
 	}
 
-	server.OnDisconnect = func() {
-		server.Broadcast([]byte("User has left the chat"))
+	server.OnDisconnect = func(connection *suede.WSConnection, code suede.CloseCode, reason string) {
+		server.Broadcast([]byte(fmt.Sprintf("User %d has left the chat", connection.ID())))
 	}
 
-	server.OnMessage = func(data []byte) {
+	server.OnMessage = func(connection *suede.WSConnection, data []byte) {
 		server.Broadcast(data)
 	}
 
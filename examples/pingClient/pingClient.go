@@ -13,12 +13,13 @@ func main() {
 		panic("ws client failed to create")
 	}
 
+	wsClient.PingInterval = 1000 * time.Millisecond
+	wsClient.PongTimeout = 500 * time.Millisecond
+	wsClient.OnPong = func(payload []byte, latency time.Duration) {
+		fmt.Printf("Pong received after %s\n", latency)
+	}
+
 	wsClient.RunCallback(func() {
 		fmt.Println("WS Client connected, pinging...")
-		tick := time.Tick(1000 * time.Millisecond)
-		for range tick {
-			fmt.Println("Pinging...")
-			wsClient.Ping()
-		}
 	})
 }
@@ -13,12 +13,16 @@ func main() {
 		panic("ws server failed to start")
 	}
 
+	wsServer.PingInterval = 1000 * time.Millisecond
+	wsServer.PongTimeout = 500 * time.Millisecond
+	wsServer.OnPong = func(connection *suede.WSConnection, payload []byte, latency time.Duration) {
+		fmt.Printf("Pong received from client %d after %s\n", connection.ID(), latency)
+	}
+	wsServer.OnDisconnect = func(connection *suede.WSConnection, code suede.CloseCode, reason string) {
+		fmt.Printf("Client %d disconnected: %d %s\n", connection.ID(), code, reason)
+	}
+
 	wsServer.RunCallback(func() {
 		fmt.Println("WebSocket server started on port 8080 at path /ping")
-		tick := time.Tick(1000 * time.Millisecond)
-		for range tick {
-			fmt.Println("Pinging...")
-			wsServer.Ping()
-		}
 	})
 }
@@ -0,0 +1,108 @@
+package suede
+
+import (
+	"errors"
+)
+
+// Reserved bits an extension may claim, matching the RSV1, RSV2 and RSV3 bits of a frame header.
+// permessage-deflate uses ReservedBit1.
+const (
+	ReservedBit1 byte = rsv1Bit
+	ReservedBit2 byte = rsv2Bit
+	ReservedBit3 byte = rsv3Bit
+)
+
+// ExtensionParams holds the parameters of one extension in a Sec-WebSocket-Extensions header.
+// Parameters given without a value map to an empty string.
+type ExtensionParams map[string]string
+
+// Extension is a WebSocket extension (RFC 6455 section 9) which is negotiated during the handshake
+// and then transforms every data message sent and received on the connection.
+//
+// Extensions work on whole messages: outgoing messages are encoded before they are fragmented, and
+// incoming messages are decoded once all their fragments have arrived. The message is passed as a
+// single *Frame carrying the message's opcode, payload and reserved bits. Extensions which also
+// transform individual frames implement FrameExtension. Control frames are never passed to an
+// extension. Calls to EncodeMessage are never made concurrently with each other, nor are calls to
+// DecodeMessage, but an encode may run at the same time as a decode.
+type Extension interface {
+	// Name returns the extension token used in the Sec-WebSocket-Extensions header.
+	Name() string
+	// ReservedBits returns the RSV bits the extension sets on the messages it encodes, as a
+	// combination of ReservedBit1, ReservedBit2 and ReservedBit3. Incoming messages with any other
+	// reserved bit set fail the connection. Two extensions claiming the same bit are never
+	// negotiated together.
+	ReservedBits() byte
+	// Offer is called on clients, and returns the parameters to offer to the server.
+	Offer() ExtensionParams
+	// Accept is called on clients with the parameters of the server's response, once the server
+	// has accepted the extension. Returning an error fails the handshake.
+	Accept(response ExtensionParams) error
+	// Negotiate is called on servers with the parameters of a client's offer. It returns the
+	// parameters of the response, and false if the offer cannot be accepted.
+	Negotiate(offer ExtensionParams) (ExtensionParams, bool)
+	// EncodeMessage transforms an outgoing message, replacing its payload and setting its reserved
+	// bits as needed. Extensions encode in the order they were negotiated.
+	EncodeMessage(message *Frame) error
+	// DecodeMessage reverses EncodeMessage for an incoming message, and should clear the reserved
+	// bits it handled. Extensions decode in the reverse of the order they were negotiated. A
+	// *WSFrameError fails the connection with its own close status; any other error fails it with
+	// CloseInvalidPayload.
+	DecodeMessage(message *Frame) error
+}
+
+// FrameExtension is an Extension which also transforms each data frame, such as per-frame
+// encryption. EncodeFrame is called on every outgoing data frame, including continuation frames,
+// once the message has been encoded and fragmented. The payload may share memory with the data
+// being sent, so it must be replaced rather than modified in place. DecodeFrame is called on every
+// incoming data frame before the message is reassembled, and should clear the reserved bits it
+// handled, as continuation frames with any reserved bit still set fail the connection. Frames are
+// encoded in the order extensions were negotiated, and decoded in the reverse order, following the
+// same rules as EncodeMessage and DecodeMessage.
+type FrameExtension interface {
+	Extension
+	EncodeFrame(frame *Frame) error
+	DecodeFrame(frame *Frame) error
+}
+
+// ExtensionFactory creates a new instance of an extension. Every connection gets its own
+// instances, so an Extension may keep per-connection state such as a compression context.
+type ExtensionFactory func() Extension
+
+// newExtensions creates the extension instances for one connection, in order of preference.
+// Compression, if set, comes first.
+func newExtensions(compression *CompressionOptions, factories []ExtensionFactory) []Extension {
+	var extensions []Extension
+	if compression != nil {
+		extensions = append(extensions, &deflateExtension{options: compression})
+	}
+
+	for _, factory := range factories {
+		extensions = append(extensions, factory())
+	}
+
+	return extensions
+}
+
+// frameExtensions returns those extensions which also transform individual frames.
+func frameExtensions(extensions []Extension) []FrameExtension {
+	var frameExtensions []FrameExtension
+	for _, extension := range extensions {
+		if frameExtension, ok := extension.(FrameExtension); ok {
+			frameExtensions = append(frameExtensions, frameExtension)
+		}
+	}
+
+	return frameExtensions
+}
+
+// decodeError is the error failing a connection when an extension cannot decode a message or
+// frame. A *WSFrameError keeps its own close status; any other error uses CloseInvalidPayload.
+func decodeError(err error) *WSFrameError {
+	var frameErr *WSFrameError
+	if !errors.As(err, &frameErr) {
+		frameErr = &WSFrameError{message: err.Error(), code: CloseInvalidPayload}
+	}
+
+	return frameErr
+}
@@ -0,0 +1,285 @@
+package suede
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame opcodes as defined in RFC 6455 section 5.2
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xA
+)
+
+const (
+	finBit  = 0b10000000
+	rsv1Bit = 0b01000000
+	rsv2Bit = 0b00100000
+	rsv3Bit = 0b00010000
+	opMask  = 0b00001111
+	maskBit = 0b10000000
+	lenMask = 0b01111111
+
+	maxControlPayload = 125
+
+	// payloadChunkSize is the largest payload allocated up front. Longer payloads grow as their
+	// data actually arrives, so that a forged length cannot force a huge allocation.
+	payloadChunkSize = 1 << 16
+)
+
+type WSFrameError struct {
+	message string
+	// code is the close status used when this error fails a connection, defaulting to
+	// CloseProtocolError when unset.
+	code CloseCode
+}
+
+func (err *WSFrameError) Error() string {
+	return err.message
+}
+
+func (err *WSFrameError) closeCode() CloseCode {
+	if err.code == 0 {
+		return CloseProtocolError
+	}
+
+	return err.code
+}
+
+// Frame is a single WebSocket frame. Payload always holds the unmasked application data; when a
+// frame is read with the mask bit set, Masked and MaskKey record the key that was used.
+type Frame struct {
+	Fin     bool
+	Rsv1    bool
+	Rsv2    bool
+	Rsv3    bool
+	OpCode  byte
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+// IsControl reports whether the frame is a control frame (close, ping or pong).
+func (frame *Frame) IsControl() bool {
+	return frame.OpCode&0x8 != 0
+}
+
+func (frame *Frame) rsvBits() byte {
+	var bits byte
+	if frame.Rsv1 {
+		bits |= rsv1Bit
+	}
+	if frame.Rsv2 {
+		bits |= rsv2Bit
+	}
+	if frame.Rsv3 {
+		bits |= rsv3Bit
+	}
+
+	return bits
+}
+
+// FrameReader reads WebSocket frames from a buffered stream. Each call to ReadFrame consumes
+// exactly the bytes belonging to one frame, so headers split across reads and multiple frames
+// arriving in a single read are both handled.
+type FrameReader struct {
+	reader *bufio.Reader
+	// maxFrameSize is the largest payload accepted, or zero for no limit.
+	maxFrameSize int64
+}
+
+// NewFrameReader creates a FrameReader reading from reader. If reader is already a *bufio.Reader
+// it is used directly, so any bytes it has buffered are not lost.
+func NewFrameReader(reader io.Reader) *FrameReader {
+	bufferedReader, ok := reader.(*bufio.Reader)
+	if !ok {
+		bufferedReader = bufio.NewReader(reader)
+	}
+
+	return &FrameReader{reader: bufferedReader}
+}
+
+// ReadFrame reads the next frame from the stream, unmasking its payload if required.
+func (frameReader *FrameReader) ReadFrame() (*Frame, error) {
+	var header [8]byte
+	if _, readErr := io.ReadFull(frameReader.reader, header[:2]); readErr != nil {
+		return nil, readErr
+	}
+
+	controlByte := header[0]
+	payloadInfoByte := header[1]
+
+	frame := &Frame{
+		Fin:    controlByte&finBit != 0,
+		Rsv1:   controlByte&rsv1Bit != 0,
+		Rsv2:   controlByte&rsv2Bit != 0,
+		Rsv3:   controlByte&rsv3Bit != 0,
+		OpCode: controlByte & opMask,
+		Masked: payloadInfoByte&maskBit != 0,
+	}
+
+	switch frame.OpCode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return nil, &WSFrameError{message: fmt.Sprintf("Reserved opcode 0x%X", frame.OpCode)}
+	}
+
+	length := uint64(payloadInfoByte & lenMask)
+	switch length {
+	case 126:
+		if _, readErr := io.ReadFull(frameReader.reader, header[:2]); readErr != nil {
+			return nil, readErr
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+
+	case 127:
+		if _, readErr := io.ReadFull(frameReader.reader, header[:8]); readErr != nil {
+			return nil, readErr
+		}
+		length = binary.BigEndian.Uint64(header[:8])
+		if length&(1<<63) != 0 {
+			return nil, &WSFrameError{message: "Most significant bit of 64-bit payload length is set"}
+		}
+	}
+
+	if frame.IsControl() {
+		if !frame.Fin {
+			return nil, &WSFrameError{message: "Control frame must not be fragmented"}
+		}
+
+		if length > maxControlPayload {
+			return nil, &WSFrameError{message: "Control frame payload exceeds 125 bytes"}
+		}
+	}
+
+	if frameReader.maxFrameSize > 0 && length > uint64(frameReader.maxFrameSize) {
+		return nil, &WSFrameError{
+			message: fmt.Sprintf("Frame payload exceeds %d bytes", frameReader.maxFrameSize),
+			code:    CloseMessageTooBig,
+		}
+	}
+
+	if frame.Masked {
+		if _, readErr := io.ReadFull(frameReader.reader, frame.MaskKey[:]); readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	payload, readErr := frameReader.readPayload(length)
+	if readErr != nil {
+		return nil, readErr
+	}
+	frame.Payload = payload
+
+	if frame.Masked {
+		maskBytes(frame.MaskKey, frame.Payload)
+	}
+
+	return frame, nil
+}
+
+// readPayload reads a payload of the given length. Short payloads are read into a buffer allocated
+// up front, while longer ones are read in chunks.
+func (frameReader *FrameReader) readPayload(length uint64) ([]byte, error) {
+	if length <= payloadChunkSize {
+		payload := make([]byte, length)
+		if _, readErr := io.ReadFull(frameReader.reader, payload); readErr != nil {
+			return nil, readErr
+		}
+		return payload, nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.Grow(payloadChunkSize)
+	copied, copyErr := io.CopyN(&buffer, frameReader.reader, int64(length))
+	if copyErr == io.EOF && copied < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// FrameWriter writes WebSocket frames to a stream. A FrameWriter created with mask set to true
+// (as required for clients) masks every frame with a freshly generated key, ignoring the Masked
+// and MaskKey fields of the frame being written.
+type FrameWriter struct {
+	writer io.Writer
+	mask   bool
+}
+
+// NewFrameWriter creates a FrameWriter writing to writer.
+func NewFrameWriter(writer io.Writer, mask bool) *FrameWriter {
+	return &FrameWriter{
+		writer: writer,
+		mask:   mask,
+	}
+}
+
+// WriteFrame encodes frame, choosing the shortest payload length encoding, and writes it to the
+// stream in a single call. The frame's payload is not modified.
+func (frameWriter *FrameWriter) WriteFrame(frame *Frame) error {
+	if frame.IsControl() && (!frame.Fin || len(frame.Payload) > maxControlPayload) {
+		return &WSFrameError{message: "Control frames must be final and carry at most 125 bytes"}
+	}
+
+	payloadLength := len(frame.Payload)
+	content := make([]byte, 0, payloadLength+14)
+
+	controlByte := frame.OpCode&opMask | frame.rsvBits()
+	if frame.Fin {
+		controlByte |= finBit
+	}
+	content = append(content, controlByte)
+
+	var maskFlag byte
+	if frameWriter.mask {
+		maskFlag = maskBit
+	}
+
+	switch {
+	case payloadLength < 126:
+		content = append(content, maskFlag|byte(payloadLength))
+
+	case payloadLength <= 0xFFFF:
+		content = append(content, maskFlag|126)
+		content = binary.BigEndian.AppendUint16(content, uint16(payloadLength))
+
+	default:
+		content = append(content, maskFlag|127)
+		content = binary.BigEndian.AppendUint64(content, uint64(payloadLength))
+	}
+
+	if frameWriter.mask {
+		var maskKey [4]byte
+		if _, randErr := rand.Read(maskKey[:]); randErr != nil {
+			return randErr
+		}
+
+		content = append(content, maskKey[:]...)
+		payloadStart := len(content)
+		content = append(content, frame.Payload...)
+		maskBytes(maskKey, content[payloadStart:])
+	} else {
+		content = append(content, frame.Payload...)
+	}
+
+	_, writeErr := frameWriter.writer.Write(content)
+	return writeErr
+}
+
+func maskBytes(maskKey [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= maskKey[i%4]
+	}
+}
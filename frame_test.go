@@ -0,0 +1,222 @@
+package suede
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		length       int
+		headerLength int
+	}{
+		{"empty", 0, 2},
+		{"7-bit length", 125, 2},
+		{"smallest 16-bit length", 126, 4},
+		{"largest 16-bit length", 0xFFFF, 4},
+		{"smallest 64-bit length", 0x10000, 10},
+		{"large 64-bit length", 200000, 10},
+	}
+
+	for _, test := range tests {
+		for _, mask := range []bool{false, true} {
+			payload := make([]byte, test.length)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			sent := append([]byte(nil), payload...)
+
+			var stream bytes.Buffer
+			writeErr := NewFrameWriter(&stream, mask).WriteFrame(&Frame{Fin: true, OpCode: OpBinary, Payload: payload})
+			if writeErr != nil {
+				t.Fatalf("%s, mask %t: WriteFrame: %s", test.name, mask, writeErr)
+			}
+
+			headerLength := test.headerLength
+			if mask {
+				headerLength += 4
+			}
+			if stream.Len() != headerLength+test.length {
+				t.Errorf("%s, mask %t: wrote %d bytes, want %d", test.name, mask, stream.Len(), headerLength+test.length)
+			}
+
+			if !bytes.Equal(payload, sent) {
+				t.Errorf("%s, mask %t: WriteFrame modified the payload", test.name, mask)
+			}
+
+			frame, readErr := NewFrameReader(&stream).ReadFrame()
+			if readErr != nil {
+				t.Fatalf("%s, mask %t: ReadFrame: %s", test.name, mask, readErr)
+			}
+
+			if !frame.Fin || frame.OpCode != OpBinary || frame.Masked != mask {
+				t.Errorf("%s, mask %t: read fin %t opcode %d masked %t", test.name, mask, frame.Fin, frame.OpCode, frame.Masked)
+			}
+
+			if !bytes.Equal(frame.Payload, payload) {
+				t.Errorf("%s, mask %t: payload does not match", test.name, mask)
+			}
+		}
+	}
+}
+
+func TestFrameReservedBits(t *testing.T) {
+	var stream bytes.Buffer
+	sent := &Frame{Rsv1: true, Rsv3: true, OpCode: OpText, Payload: []byte("part")}
+	if writeErr := NewFrameWriter(&stream, false).WriteFrame(sent); writeErr != nil {
+		t.Fatalf("WriteFrame: %s", writeErr)
+	}
+
+	if stream.Bytes()[0] != 0x51 {
+		t.Errorf("first byte is 0x%X, want 0x51", stream.Bytes()[0])
+	}
+
+	frame, readErr := NewFrameReader(&stream).ReadFrame()
+	if readErr != nil {
+		t.Fatalf("ReadFrame: %s", readErr)
+	}
+
+	if frame.Fin || !frame.Rsv1 || frame.Rsv2 || !frame.Rsv3 {
+		t.Errorf("read fin %t rsv %t %t %t", frame.Fin, frame.Rsv1, frame.Rsv2, frame.Rsv3)
+	}
+}
+
+// The examples of RFC 6455 section 5.7.
+func TestReadFrameRFCExamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		opCode  byte
+		fin     bool
+		payload string
+	}{
+		{"unmasked text", []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, OpText, true, "Hello"},
+		{"masked text", []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, OpText, true, "Hello"},
+		{"first fragment", []byte{0x01, 0x03, 0x48, 0x65, 0x6c}, OpText, false, "Hel"},
+		{"last fragment", []byte{0x80, 0x02, 0x6c, 0x6f}, OpContinuation, true, "lo"},
+		{"ping", []byte{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, OpPing, true, "Hello"},
+	}
+
+	for _, test := range tests {
+		frame, readErr := NewFrameReader(bytes.NewReader(test.data)).ReadFrame()
+		if readErr != nil {
+			t.Errorf("%s: ReadFrame: %s", test.name, readErr)
+			continue
+		}
+
+		if frame.OpCode != test.opCode || frame.Fin != test.fin || string(frame.Payload) != test.payload {
+			t.Errorf("%s: read opcode %d fin %t payload %q", test.name, frame.OpCode, frame.Fin, frame.Payload)
+		}
+	}
+}
+
+func TestReadFrameSplitAcrossReads(t *testing.T) {
+	var stream bytes.Buffer
+	frameWriter := NewFrameWriter(&stream, true)
+	frameWriter.WriteFrame(&Frame{Fin: true, OpCode: OpText, Payload: bytes.Repeat([]byte("a"), 300)})
+	frameWriter.WriteFrame(&Frame{Fin: true, OpCode: OpPing, Payload: []byte("ping")})
+	frameWriter.WriteFrame(&Frame{Fin: true, OpCode: OpBinary, Payload: []byte{1, 2, 3}})
+
+	frameReader := NewFrameReader(iotest.OneByteReader(&stream))
+	want := []struct {
+		opCode byte
+		length int
+	}{
+		{OpText, 300},
+		{OpPing, 4},
+		{OpBinary, 3},
+	}
+
+	for _, expected := range want {
+		frame, readErr := frameReader.ReadFrame()
+		if readErr != nil {
+			t.Fatalf("ReadFrame: %s", readErr)
+		}
+
+		if frame.OpCode != expected.opCode || len(frame.Payload) != expected.length {
+			t.Errorf("read opcode %d with %d bytes, want opcode %d with %d bytes", frame.OpCode, len(frame.Payload), expected.opCode, expected.length)
+		}
+	}
+
+	if _, readErr := frameReader.ReadFrame(); readErr != io.EOF {
+		t.Errorf("ReadFrame at end of stream returned %v, want io.EOF", readErr)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		maxFrameSize int64
+		code         CloseCode
+	}{
+		{"reserved data opcode", []byte{0x83, 0x00}, 0, CloseProtocolError},
+		{"reserved control opcode", []byte{0x8B, 0x00}, 0, CloseProtocolError},
+		{"fragmented control frame", []byte{0x09, 0x00}, 0, CloseProtocolError},
+		{"oversized control frame", []byte{0x89, 0x7E, 0x00, 0x7E}, 0, CloseProtocolError},
+		{"64-bit length with high bit set", []byte{0x82, 0x7F, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, CloseProtocolError},
+		{"frame over size limit", []byte{0x82, 0x7E, 0x01, 0x00}, 255, CloseMessageTooBig},
+	}
+
+	for _, test := range tests {
+		frameReader := NewFrameReader(bytes.NewReader(test.data))
+		frameReader.maxFrameSize = test.maxFrameSize
+
+		_, readErr := frameReader.ReadFrame()
+		var frameErr *WSFrameError
+		if !errors.As(readErr, &frameErr) {
+			t.Errorf("%s: ReadFrame returned %v, want a *WSFrameError", test.name, readErr)
+			continue
+		}
+
+		if frameErr.closeCode() != test.code {
+			t.Errorf("%s: close code %d, want %d", test.name, frameErr.closeCode(), test.code)
+		}
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"extended length", []byte{0x82, 0x7E, 0x01}},
+		{"mask key", []byte{0x82, 0x85, 0x01, 0x02}},
+		{"short payload", []byte{0x82, 0x05, 0x01, 0x02}},
+		{"long payload", append([]byte{0x82, 0x7F, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}, make([]byte, 1000)...)},
+	}
+
+	for _, test := range tests {
+		_, readErr := NewFrameReader(bytes.NewReader(test.data)).ReadFrame()
+		if readErr != io.ErrUnexpectedEOF {
+			t.Errorf("%s: ReadFrame returned %v, want io.ErrUnexpectedEOF", test.name, readErr)
+		}
+	}
+}
+
+func TestWriteFrameControlLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"fragmented ping", &Frame{OpCode: OpPing}},
+		{"oversized pong", &Frame{Fin: true, OpCode: OpPong, Payload: make([]byte, 126)}},
+	}
+
+	for _, test := range tests {
+		var stream bytes.Buffer
+		writeErr := NewFrameWriter(&stream, false).WriteFrame(test.frame)
+		var frameErr *WSFrameError
+		if !errors.As(writeErr, &frameErr) {
+			t.Errorf("%s: WriteFrame returned %v, want a *WSFrameError", test.name, writeErr)
+		}
+
+		if stream.Len() != 0 {
+			t.Errorf("%s: wrote %d bytes", test.name, stream.Len())
+		}
+	}
+}
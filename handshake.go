@@ -0,0 +1,198 @@
+package suede
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// headerContainsToken reports whether any of the comma separated values of the named header match
+// token, ignoring case. Headers such as Connection may list several tokens, e.g. "keep-alive,
+// Upgrade".
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// headerTokens returns every comma separated value of the named header, with surrounding
+// whitespace removed and empty values skipped.
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if token := strings.TrimSpace(element); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	return tokens
+}
+
+// validateUpgradeRequest checks req against the opening handshake requirements of RFC 6455
+// section 4.2.1. If the request is invalid, the HTTP status to reply with and a description of the
+// problem are returned; otherwise the status is 0.
+func validateUpgradeRequest(req *http.Request) (int, string) {
+	if req.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, "WebSocket handshake must use the GET method"
+	}
+
+	if !req.ProtoAtLeast(1, 1) {
+		return http.StatusBadRequest, "WebSocket handshake requires HTTP/1.1 or higher"
+	}
+
+	if !headerContainsToken(req.Header, "Upgrade", "websocket") {
+		return http.StatusUpgradeRequired, "Request header not requesting websocket upgrade"
+	}
+
+	if !headerContainsToken(req.Header, "Connection", "upgrade") {
+		return http.StatusBadRequest, "Request missing Connection: Upgrade header"
+	}
+
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, "Unsupported WebSocket version"
+	}
+
+	wsKey := req.Header.Get("Sec-WebSocket-Key")
+	if wsKey == "" {
+		return http.StatusBadRequest, "Request missing Sec-WebSocket-Key header"
+	}
+
+	decodedKey, decodeErr := base64.StdEncoding.DecodeString(wsKey)
+	if decodeErr != nil || len(decodedKey) != 16 {
+		return http.StatusBadRequest, "Invalid Sec-WebSocket-Key header"
+	}
+
+	return 0, ""
+}
+
+// extensionOffer is a single extension listed in a Sec-WebSocket-Extensions header, with its
+// parameters. Parameters given without a value map to an empty string.
+type extensionOffer struct {
+	name   string
+	params ExtensionParams
+}
+
+// parseExtensions parses every extension listed in the Sec-WebSocket-Extensions headers, in the
+// order they were given.
+func parseExtensions(header http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, element := range headerTokens(header, "Sec-WebSocket-Extensions") {
+		parts := strings.Split(element, ";")
+		offer := extensionOffer{
+			name:   strings.TrimSpace(parts[0]),
+			params: make(ExtensionParams),
+		}
+
+		for _, part := range parts[1:] {
+			name, value, _ := strings.Cut(part, "=")
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+
+			offer.params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+
+		offers = append(offers, offer)
+	}
+
+	return offers
+}
+
+// String formats the extension as it appears in a Sec-WebSocket-Extensions header. Parameters are
+// sorted so that the header is deterministic.
+func (offer extensionOffer) String() string {
+	names := make([]string, 0, len(offer.params))
+	for name := range offer.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString(offer.name)
+	for _, name := range names {
+		builder.WriteString("; ")
+		builder.WriteString(name)
+		if value := offer.params[name]; value != "" {
+			builder.WriteString("=")
+			builder.WriteString(value)
+		}
+	}
+
+	return builder.String()
+}
+
+// reservedResponseHeaders are written by the handshake itself, and cannot be added to the 101
+// response. Sec-WebSocket-Protocol is handled separately, as it may select a subprotocol.
+var reservedResponseHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Version":    true,
+	"Content-Length":           true,
+	"Transfer-Encoding":        true,
+}
+
+// validateResponseHeader checks that header can be added to a 101 response without breaking the
+// handshake. Names must be valid HTTP tokens, values must not contain control characters, and the
+// headers written by the handshake itself cannot be set.
+func validateResponseHeader(header http.Header) error {
+	for name, values := range header {
+		if !validHeaderName(name) {
+			return &WSServerError{message: fmt.Sprintf("Invalid response header name %q", name)}
+		}
+
+		if reservedResponseHeaders[http.CanonicalHeaderKey(name)] {
+			return &WSServerError{message: fmt.Sprintf("Response header %s is set by the handshake", name)}
+		}
+
+		for _, value := range values {
+			if !validHeaderValue(value) {
+				return &WSServerError{message: fmt.Sprintf("Invalid value for response header %s", name)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validHeaderName reports whether name is a token as defined in RFC 7230 section 3.2.6.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, char := range []byte(name) {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", char) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// validHeaderValue reports whether value contains no control characters other than tabs, so that
+// it cannot end the header line early.
+func validHeaderValue(value string) bool {
+	for _, char := range []byte(value) {
+		if (char < ' ' && char != '\t') || char == 0x7F {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,213 @@
+package suede
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// upgradeRequest returns a valid opening handshake request, which tests then break.
+func upgradeRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://server.example.com/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	return req
+}
+
+func TestValidateUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		status int
+	}{
+		{"valid", func(req *http.Request) {}, 0},
+		{"token lists and case", func(req *http.Request) {
+			req.Header.Set("Upgrade", "WebSocket")
+			req.Header.Set("Connection", "keep-alive, upgrade")
+		}, 0},
+		{"POST", func(req *http.Request) {
+			req.Method = http.MethodPost
+		}, http.StatusMethodNotAllowed},
+		{"HTTP/1.0", func(req *http.Request) {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		}, http.StatusBadRequest},
+		{"missing Upgrade", func(req *http.Request) {
+			req.Header.Del("Upgrade")
+		}, http.StatusUpgradeRequired},
+		{"other Upgrade", func(req *http.Request) {
+			req.Header.Set("Upgrade", "h2c")
+		}, http.StatusUpgradeRequired},
+		{"missing Connection", func(req *http.Request) {
+			req.Header.Del("Connection")
+		}, http.StatusBadRequest},
+		{"Connection without upgrade", func(req *http.Request) {
+			req.Header.Set("Connection", "keep-alive")
+		}, http.StatusBadRequest},
+		{"missing version", func(req *http.Request) {
+			req.Header.Del("Sec-WebSocket-Version")
+		}, http.StatusUpgradeRequired},
+		{"old version", func(req *http.Request) {
+			req.Header.Set("Sec-WebSocket-Version", "8")
+		}, http.StatusUpgradeRequired},
+		{"missing key", func(req *http.Request) {
+			req.Header.Del("Sec-WebSocket-Key")
+		}, http.StatusBadRequest},
+		{"key not base64", func(req *http.Request) {
+			req.Header.Set("Sec-WebSocket-Key", "not base64!")
+		}, http.StatusBadRequest},
+		{"key too short", func(req *http.Request) {
+			req.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=")
+		}, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := upgradeRequest()
+			test.modify(req)
+
+			status, message := validateUpgradeRequest(req)
+			if status != test.status {
+				t.Errorf("validateUpgradeRequest = %d %q, want %d", status, message, test.status)
+			}
+			if (status == 0) != (message == "") {
+				t.Errorf("validateUpgradeRequest returned status %d with message %q", status, message)
+			}
+		})
+	}
+}
+
+func TestUpgradeRejectsInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		status int
+		header string
+		value  string
+	}{
+		{"POST", func(req *http.Request) {
+			req.Method = http.MethodPost
+		}, http.StatusMethodNotAllowed, "Allow", http.MethodGet},
+		{"plain HTTP", func(req *http.Request) {
+			req.Header.Del("Upgrade")
+		}, http.StatusUpgradeRequired, "Sec-WebSocket-Version", "13"},
+		{"missing key", func(req *http.Request) {
+			req.Header.Del("Sec-WebSocket-Key")
+		}, http.StatusBadRequest, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := upgradeRequest()
+			test.modify(req)
+			recorder := httptest.NewRecorder()
+
+			wsServer := &wsserver{}
+			if _, upgradeErr := wsServer.upgrade(recorder, req); upgradeErr == nil {
+				t.Fatalf("upgrade accepted an invalid request")
+			}
+
+			if recorder.Code != test.status {
+				t.Errorf("response status %d, want %d", recorder.Code, test.status)
+			}
+			if test.header != "" && recorder.Header().Get(test.header) != test.value {
+				t.Errorf("response header %s = %q, want %q", test.header, recorder.Header().Get(test.header), test.value)
+			}
+		})
+	}
+}
+
+func TestValidateResponseHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		valid  bool
+	}{
+		{"empty", http.Header{}, true},
+		{"custom headers", http.Header{"X-Server": {"suede"}, "Set-Cookie": {"session=abc; Path=/", "theme=dark"}}, true},
+		{"value with tab", http.Header{"X-Trace": {"a\tb"}}, true},
+		{"token punctuation", http.Header{"X-Custom_Header.v1!": {"ok"}}, true},
+		{"empty name", http.Header{"": {"value"}}, false},
+		{"name with space", http.Header{"X Server": {"suede"}}, false},
+		{"name with colon", http.Header{"X-Server:": {"suede"}}, false},
+		{"value with CRLF", http.Header{"X-Server": {"suede\r\nX-Injected: true"}}, false},
+		{"value with newline", http.Header{"X-Server": {"suede\nX-Injected: true"}}, false},
+		{"value with DEL", http.Header{"X-Server": {"suede\x7F"}}, false},
+		{"Upgrade", http.Header{"Upgrade": {"h2c"}}, false},
+		{"Connection", http.Header{"Connection": {"close"}}, false},
+		{"Sec-WebSocket-Accept", http.Header{"Sec-Websocket-Accept": {"forged"}}, false},
+		{"Sec-WebSocket-Extensions", http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}}, false},
+		{"Sec-WebSocket-Version", http.Header{"Sec-Websocket-Version": {"13"}}, false},
+		{"Content-Length", http.Header{"Content-Length": {"0"}}, false},
+		{"Transfer-Encoding", http.Header{"Transfer-Encoding": {"chunked"}}, false},
+		{"reserved in other case", http.Header{"content-length": {"0"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validateErr := validateResponseHeader(test.header)
+			if (validateErr == nil) != test.valid {
+				t.Errorf("validateResponseHeader(%q) = %v, want valid %t", test.header, validateErr, test.valid)
+			}
+		})
+	}
+}
+
+func TestValidateHandshakeResponse(t *testing.T) {
+	const accept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	tests := []struct {
+		name     string
+		response string
+		valid    bool
+		status   int
+		body     string
+	}{
+		{"valid", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n", true, 101, ""},
+		{"header case", "HTTP/1.1 101 Switching Protocols\r\nupgrade: WebSocket\r\nCONNECTION: keep-alive, UPGRADE\r\nsec-websocket-accept: " + accept + "\r\n\r\n", true, 101, ""},
+		{"rejected", "HTTP/1.1 403 Forbidden\r\nContent-Length: 9\r\n\r\nforbidden", false, 403, "forbidden"},
+		{"long body", "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 5000\r\n\r\n" + strings.Repeat("x", 5000), false, 500, strings.Repeat("x", maxHandshakeErrorBody)},
+		{"not found", "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", false, 404, ""},
+		{"missing Upgrade", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n", false, 101, ""},
+		{"other Upgrade", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: h2c\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n", false, 101, ""},
+		{"missing Connection", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n", false, 101, ""},
+		{"Connection without upgrade", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: keep-alive\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n", false, 101, ""},
+		{"missing accept", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", false, 101, ""},
+		{"wrong accept", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", false, 101, ""},
+		{"accept differs in case", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: S3PPLMBITXAQ9KYGZZHZRBK+XOO=\r\n\r\n", false, 101, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, readErr := http.ReadResponse(bufio.NewReader(strings.NewReader(test.response)), nil)
+			if readErr != nil {
+				t.Fatalf("ReadResponse: %s", readErr)
+			}
+
+			validateErr := validateHandshakeResponse(response, accept)
+			if test.valid {
+				if validateErr != nil {
+					t.Errorf("validateHandshakeResponse rejected a valid response: %s", validateErr)
+				}
+				return
+			}
+
+			var handshakeErr *WSHandshakeError
+			if !errors.As(validateErr, &handshakeErr) {
+				t.Fatalf("validateHandshakeResponse returned %v, want a *WSHandshakeError", validateErr)
+			}
+			if handshakeErr.StatusCode != test.status {
+				t.Errorf("StatusCode %d, want %d", handshakeErr.StatusCode, test.status)
+			}
+			if string(handshakeErr.Body) != test.body {
+				t.Errorf("Body %q, want %q", handshakeErr.Body, test.body)
+			}
+			if handshakeErr.Header == nil {
+				t.Errorf("Header is nil")
+			}
+		})
+	}
+}
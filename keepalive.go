@@ -0,0 +1,168 @@
+package suede
+
+import (
+	"time"
+)
+
+// keepaliveState tracks the pings sent on a connection, so that pongs can be timed and an
+// unresponsive peer detected.
+type keepaliveState struct {
+	// pingSent is when the oldest unanswered ping was sent, or zero if every ping has been
+	// answered.
+	pingSent time.Time
+	lastPong time.Time
+	onPing   func(payload []byte)
+	onPong   func(payload []byte, latency time.Duration)
+	stop     chan struct{}
+}
+
+// startKeepalive pings the peer every interval until the connection closes. If no pong arrives
+// within timeout of a ping, the connection is dropped. A zero timeout waits for one interval.
+func (connection *WSConnection) startKeepalive(interval time.Duration, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	stop := make(chan struct{})
+	connection.closeMutex.Lock()
+	connection.keepalive.stop = stop
+	connection.closeMutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		// pongDeadline fires once the oldest unanswered ping is due a pong. It is only armed while
+		// a ping is unanswered, and runs apart from the ticker so that pings are still sent on
+		// every tick when timeout is longer than interval.
+		var pongTimer *time.Timer
+		var pongDeadline <-chan time.Time
+		defer func() {
+			if pongTimer != nil {
+				pongTimer.Stop()
+			}
+		}()
+
+		for true {
+			select {
+			case <-stop:
+				return
+
+			case <-ticker.C:
+				// the ping may wait behind a frame the peer has stopped reading, so the pong
+				// deadline runs from when the ping is attempted rather than once it is written
+				connection.pingSent()
+				go connection.writeFrame(&Frame{Fin: true, OpCode: OpPing})
+
+			case <-pongDeadline:
+				pongDeadline = nil
+			}
+
+			remaining, waiting := connection.pongDue(timeout)
+			if !waiting || pongDeadline != nil {
+				continue
+			}
+
+			if remaining <= 0 {
+				connection.pongTimedOut(timeout)
+				return
+			}
+
+			pongTimer = time.NewTimer(remaining)
+			pongDeadline = pongTimer.C
+		}
+	}()
+}
+
+// pongTimedOut drops a connection whose peer has not answered a ping within timeout. The writer
+// may be stuck behind a frame the dead peer will never read, so no close frame is sent, and the
+// network connection is closed outright. The read loop then reports CloseAbnormalClosure.
+func (connection *WSConnection) pongTimedOut(timeout time.Duration) {
+	timeoutErr := &WSTimeoutError{Op: "pong", Duration: timeout}
+	if connection.onError != nil {
+		connection.onError(timeoutErr)
+	}
+
+	connection.closeMutex.Lock()
+	connection.dropStatus = &WSCloseError{Code: CloseAbnormalClosure, Reason: timeoutErr.reason()}
+	connection.closeMutex.Unlock()
+
+	connection.conn.Close()
+}
+
+// LastPong returns when the most recent pong was received from the peer, or the zero time if
+// none has been.
+func (connection *WSConnection) LastPong() time.Time {
+	connection.closeMutex.Lock()
+	defer connection.closeMutex.Unlock()
+
+	return connection.keepalive.lastPong
+}
+
+// pingSent records that a ping has been sent, unless an earlier ping is still unanswered.
+func (connection *WSConnection) pingSent() {
+	connection.closeMutex.Lock()
+	defer connection.closeMutex.Unlock()
+
+	if connection.keepalive.pingSent.IsZero() {
+		connection.keepalive.pingSent = time.Now()
+	}
+}
+
+// receivePing answers a ping from the peer with a pong echoing its payload.
+func (connection *WSConnection) receivePing(payload []byte) {
+	connection.writeFrame(&Frame{Fin: true, OpCode: OpPong, Payload: payload})
+
+	if connection.keepalive.onPing != nil {
+		connection.keepalive.onPing(payload)
+	}
+}
+
+// receivePong records a pong from the peer, reporting the round-trip time of the ping it answers.
+// Unsolicited pongs are reported with a latency of zero.
+func (connection *WSConnection) receivePong(payload []byte) {
+	now := time.Now()
+
+	connection.closeMutex.Lock()
+	pingSent := connection.keepalive.pingSent
+	connection.keepalive.pingSent = time.Time{}
+	connection.keepalive.lastPong = now
+	onPong := connection.keepalive.onPong
+	connection.closeMutex.Unlock()
+
+	if onPong == nil {
+		return
+	}
+
+	var latency time.Duration
+	if !pingSent.IsZero() {
+		latency = now.Sub(pingSent)
+	}
+	onPong(payload, latency)
+}
+
+// pongDue returns how long remains until the oldest unanswered ping has waited timeout for its
+// pong, which is zero or less once it has. waiting is false if every ping has been answered.
+func (connection *WSConnection) pongDue(timeout time.Duration) (remaining time.Duration, waiting bool) {
+	connection.closeMutex.Lock()
+	defer connection.closeMutex.Unlock()
+
+	pingSent := connection.keepalive.pingSent
+	if pingSent.IsZero() {
+		return 0, false
+	}
+
+	return timeout - time.Since(pingSent), true
+}
+
+// stopKeepalive stops pinging the peer. It must be called while holding closeMutex.
+func (connection *WSConnection) stopKeepalive() {
+	if connection.keepalive.stop != nil {
+		close(connection.keepalive.stop)
+		connection.keepalive.stop = nil
+	}
+}
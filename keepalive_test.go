@@ -0,0 +1,158 @@
+package suede
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDropsPeerBehindStuckWrite(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		connection, upgradeErr := Upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+		defer connection.conn.Close()
+
+		// never read, as a dead peer would, so that the client's writes block
+		<-release
+	}))
+	defer httpServer.Close()
+
+	wsClient, _ := WebSocket(httpServer.URL)
+	wsClient.PingInterval = 200 * time.Millisecond
+	wsClient.PongTimeout = 200 * time.Millisecond
+	errs := make(chan error, 1)
+	wsClient.OnError = func(err error) {
+		errs <- err
+	}
+	disconnects := make(chan CloseCode, 1)
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		disconnects <- code
+	}
+
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	defer wg.Wait()
+	defer wsClient.currentConnection().conn.Close()
+
+	go wsClient.SendBinary(make([]byte, 64<<20))
+
+	var timeoutErr *WSTimeoutError
+	if err := receive(t, errs, "pong timeout"); !errors.As(err, &timeoutErr) || timeoutErr.Op != "pong" {
+		t.Errorf("OnError received %v, want a pong *WSTimeoutError", err)
+	}
+
+	if code := receive(t, disconnects, "client disconnect"); code != CloseAbnormalClosure {
+		t.Errorf("client disconnected with %d, want %d", code, CloseAbnormalClosure)
+	}
+}
+
+func TestKeepalivePingsEveryIntervalWithLongerPongTimeout(t *testing.T) {
+	const pongTimeout = 2 * time.Second
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.ReadTimeout = time.Second
+	})
+	pongs := make(chan time.Duration, 64)
+	client := newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.PingInterval = 100 * time.Millisecond
+		wsClient.PongTimeout = pongTimeout
+		wsClient.OnPong = func(payload []byte, latency time.Duration) {
+			pongs <- latency
+		}
+	})
+
+	// pings are sent every interval, rather than once each pong timeout, which also keeps the
+	// server's read timeout from expiring
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		receive(t, pongs, "pong")
+	}
+	if elapsed := time.Since(start); elapsed >= pongTimeout {
+		t.Errorf("12 pongs took %s, want about 1.2s", elapsed)
+	}
+
+	select {
+	case code := <-client.disconnects:
+		t.Errorf("client disconnected with %d", code)
+	case err := <-server.errors:
+		t.Errorf("server failed the connection: %s", err)
+	default:
+	}
+}
+
+func TestPingPayloadRoundTrip(t *testing.T) {
+	type pong struct {
+		payload string
+		latency time.Duration
+	}
+	serverPings := make(chan string, 1)
+	serverPongs := make(chan pong, 1)
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.OnPing = func(connection *WSConnection, payload []byte) {
+			serverPings <- string(payload)
+		}
+		wsServer.OnPong = func(connection *WSConnection, payload []byte, latency time.Duration) {
+			serverPongs <- pong{string(payload), latency}
+		}
+	})
+	clientPings := make(chan string, 1)
+	clientPongs := make(chan pong, 1)
+	client := newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.OnPing = func(payload []byte) {
+			clientPings <- string(payload)
+		}
+		wsClient.OnPong = func(payload []byte, latency time.Duration) {
+			clientPongs <- pong{string(payload), latency}
+		}
+	})
+
+	if pingErr := client.Ping([]byte("stamp")); pingErr != nil {
+		t.Fatalf("client Ping: %s", pingErr)
+	}
+	if payload := receive(t, serverPings, "server OnPing"); payload != "stamp" {
+		t.Errorf("server OnPing received %q, want %q", payload, "stamp")
+	}
+	if received := receive(t, clientPongs, "client OnPong"); received.payload != "stamp" || received.latency <= 0 {
+		t.Errorf("client OnPong received %q after %s, want %q with a latency", received.payload, received.latency, "stamp")
+	}
+
+	if pingErr := server.Ping([]byte("server stamp")); pingErr != nil {
+		t.Fatalf("server Ping: %s", pingErr)
+	}
+	if payload := receive(t, clientPings, "client OnPing"); payload != "server stamp" {
+		t.Errorf("client OnPing received %q, want %q", payload, "server stamp")
+	}
+	if received := receive(t, serverPongs, "server OnPong"); received.payload != "server stamp" || received.latency <= 0 {
+		t.Errorf("server OnPong received %q after %s, want %q with a latency", received.payload, received.latency, "server stamp")
+	}
+
+	tooLong := make([]byte, maxControlPayload+1)
+	if pingErr := client.Ping(tooLong); pingErr == nil {
+		t.Errorf("client Ping accepted a %d byte payload", len(tooLong))
+	}
+	if pingErr := client.currentConnection().Ping(tooLong); pingErr == nil {
+		t.Errorf("WSConnection.Ping accepted a %d byte payload", len(tooLong))
+	}
+	if pingErr := server.Ping(tooLong); pingErr == nil {
+		t.Errorf("server Ping accepted a %d byte payload", len(tooLong))
+	}
+
+	// the longest payload allowed is still echoed
+	longest := strings.Repeat("p", maxControlPayload)
+	if pingErr := client.Ping([]byte(longest)); pingErr != nil {
+		t.Fatalf("client Ping with a %d byte payload: %s", len(longest), pingErr)
+	}
+	if received := receive(t, clientPongs, "client OnPong"); received.payload != longest {
+		t.Errorf("client OnPong received %d bytes, want %d", len(received.payload), len(longest))
+	}
+}
@@ -0,0 +1,197 @@
+package suede
+
+import (
+	"fmt"
+	"time"
+)
+
+// MessageType identifies whether a data message carries UTF-8 text or binary data.
+type MessageType byte
+
+const (
+	TextMessage   MessageType = MessageType(OpText)
+	BinaryMessage MessageType = MessageType(OpBinary)
+)
+
+func (messageType MessageType) String() string {
+	switch messageType {
+	case TextMessage:
+		return "text"
+	case BinaryMessage:
+		return "binary"
+	default:
+		return fmt.Sprintf("MessageType(0x%X)", byte(messageType))
+	}
+}
+
+func (messageType MessageType) valid() bool {
+	return messageType == TextMessage || messageType == BinaryMessage
+}
+
+// messageReader reassembles fragmented data messages from a FrameReader. Control frames may be
+// interleaved between the fragments of a message, and are passed to handleControl as they
+// arrive. Any error returned by handleControl stops the read and is returned to the caller.
+type messageReader struct {
+	frameReader   *FrameReader
+	expectMasked  bool
+	handleControl func(frame *Frame) error
+	// frameExtensions decode each data frame, in reverse order, before it is reassembled.
+	frameExtensions []FrameExtension
+	// allowedRsv holds the reserved bits which negotiated extensions permit on data frames. Any
+	// other reserved bit fails the connection.
+	allowedRsv byte
+	// maxMessageSize is the largest message accepted, or zero for no limit.
+	maxMessageSize int64
+	// readTimeout, if set, limits how long to wait for each frame to arrive, using
+	// setReadDeadline.
+	readTimeout     time.Duration
+	setReadDeadline func(time.Time) error
+}
+
+func newMessageReader(frameReader *FrameReader, expectMasked bool, handleControl func(*Frame) error) *messageReader {
+	return &messageReader{
+		frameReader:   frameReader,
+		expectMasked:  expectMasked,
+		handleControl: handleControl,
+	}
+}
+
+// readMessage reads frames until a complete data message has been received. The message is
+// returned as a single frame carrying the opcode and reserved bits of the first fragment, and the
+// concatenated payloads of every fragment.
+func (reader *messageReader) readMessage() (*Frame, error) {
+	var message *Frame
+
+	for true {
+		if reader.readTimeout > 0 {
+			reader.setReadDeadline(time.Now().Add(reader.readTimeout))
+		}
+
+		frame, readErr := reader.frameReader.ReadFrame()
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		if frame.Masked != reader.expectMasked {
+			if reader.expectMasked {
+				return nil, &WSFrameError{message: "Client should set mask bit"}
+			}
+			return nil, &WSFrameError{message: "Server should not set mask bit"}
+		}
+
+		if frame.IsControl() {
+			if frame.rsvBits() != 0 {
+				return nil, &WSFrameError{message: "Reserved bits set on control frame"}
+			}
+
+			if reader.handleControl != nil {
+				if controlErr := reader.handleControl(frame); controlErr != nil {
+					return nil, controlErr
+				}
+			}
+			continue
+		}
+
+		for index := len(reader.frameExtensions) - 1; index >= 0; index-- {
+			if decodeErr := reader.frameExtensions[index].DecodeFrame(frame); decodeErr != nil {
+				return nil, decodeError(decodeErr)
+			}
+		}
+
+		if frame.OpCode == OpContinuation {
+			if message == nil {
+				return nil, &WSFrameError{message: "Continuation frame received outside of a fragmented message"}
+			}
+
+			if frame.rsvBits() != 0 {
+				return nil, &WSFrameError{message: "Reserved bits set on continuation frame"}
+			}
+
+			if reader.maxMessageSize > 0 && int64(len(message.Payload)+len(frame.Payload)) > reader.maxMessageSize {
+				return nil, messageTooBig(reader.maxMessageSize)
+			}
+
+			message.Payload = append(message.Payload, frame.Payload...)
+		} else {
+			if message != nil {
+				return nil, &WSFrameError{message: "New data frame received before fragmented message completed"}
+			}
+
+			if frame.rsvBits()&^reader.allowedRsv != 0 {
+				return nil, &WSFrameError{message: "Reserved bits set without a negotiated extension"}
+			}
+
+			message = frame
+			message.Masked = false
+		}
+
+		if frame.Fin {
+			break
+		}
+	}
+
+	message.Fin = true
+	if message.Payload == nil {
+		message.Payload = []byte{}
+	}
+
+	return message, nil
+}
+
+// messageTooBig is the error for a message which exceeds the size limit, failing the connection
+// with CloseMessageTooBig.
+func messageTooBig(maxMessageSize int64) *WSFrameError {
+	return &WSFrameError{
+		message: fmt.Sprintf("Message exceeds %d bytes", maxMessageSize),
+		code:    CloseMessageTooBig,
+	}
+}
+
+// writeFragmented writes message split into frames carrying at most fragmentSize bytes each. The
+// first frame carries the message's opcode and reserved bits, and the rest are continuation
+// frames.
+func writeFragmented(writeFrame func(*Frame) error, message *Frame, fragmentSize int) error {
+	if sizeErr := checkFragmentSize(fragmentSize); sizeErr != nil {
+		return sizeErr
+	}
+
+	data := message.Payload
+	frame := &Frame{
+		OpCode: message.OpCode,
+		Rsv1:   message.Rsv1,
+		Rsv2:   message.Rsv2,
+		Rsv3:   message.Rsv3,
+	}
+
+	for true {
+		fragmentLength := len(data)
+		if fragmentLength > fragmentSize {
+			fragmentLength = fragmentSize
+		}
+
+		frame.Fin = fragmentLength == len(data)
+		frame.Payload = data[:fragmentLength]
+
+		if writeErr := writeFrame(frame); writeErr != nil {
+			return writeErr
+		}
+
+		if frame.Fin {
+			break
+		}
+
+		data = data[fragmentLength:]
+		frame = &Frame{OpCode: OpContinuation}
+	}
+
+	return nil
+}
+
+// checkFragmentSize rejects a fragment size which could not split a message.
+func checkFragmentSize(fragmentSize int) error {
+	if fragmentSize <= 0 {
+		return &WSFrameError{message: "Fragment size must be greater than zero"}
+	}
+
+	return nil
+}
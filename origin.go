@@ -0,0 +1,69 @@
+package suede
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkOrigin reports whether the server accepts the Origin of an upgrade request. CheckOrigin is
+// used if set. Otherwise requests without an Origin header, which browsers always send, are
+// accepted, as are requests from the server's own origin or one listed in AllowedOrigins.
+func (wsServer *wsserver) checkOrigin(req *http.Request) bool {
+	if wsServer.CheckOrigin != nil {
+		return wsServer.CheckOrigin(req)
+	}
+
+	rawOrigin := req.Header.Get("Origin")
+	if rawOrigin == "" {
+		return true
+	}
+
+	origin, parseErr := url.Parse(rawOrigin)
+	if parseErr != nil || origin.Host == "" {
+		return false
+	}
+
+	if strings.EqualFold(origin.Host, req.Host) {
+		return true
+	}
+
+	for _, pattern := range wsServer.AllowedOrigins {
+		if originMatches(origin, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originMatches reports whether origin matches an AllowedOrigins pattern. A pattern is either "*",
+// a full origin such as "https://example.com", or a host such as "example.com" which matches any
+// scheme. A host starting with "*." matches any subdomain, but not the domain itself. Hosts
+// without a port match any port.
+func originMatches(origin *url.URL, pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	scheme, host, hasScheme := strings.Cut(pattern, "://")
+	if !hasScheme {
+		host = pattern
+	} else if !strings.EqualFold(scheme, origin.Scheme) {
+		return false
+	}
+
+	originHost := origin.Host
+	if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+		originHost = origin.Hostname()
+	}
+	originHost = strings.ToLower(originHost)
+	host = strings.ToLower(host)
+
+	if suffix, isWildcard := strings.CutPrefix(host, "*."); isWildcard {
+		return strings.HasSuffix(originHost, "."+suffix)
+	}
+
+	return originHost == host
+}
@@ -0,0 +1,90 @@
+package suede
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"missing origin", "", nil, true},
+		{"same origin", "http://server.example.com", nil, true},
+		{"same origin ignores case", "http://SERVER.example.com", nil, true},
+		{"cross origin", "https://evil.example.net", nil, false},
+		{"null origin", "null", nil, false},
+		{"null origin with wildcard", "null", []string{"*"}, false},
+		{"unparseable origin", "http://%zz", []string{"*"}, false},
+		{"allow every origin", "https://evil.example.net", []string{"*"}, true},
+		{"full origin", "https://app.example.org", []string{"https://app.example.org"}, true},
+		{"full origin wrong scheme", "http://app.example.org", []string{"https://app.example.org"}, false},
+		{"scheme ignores case", "https://app.example.org", []string{"HTTPS://app.example.org"}, true},
+		{"host matches any scheme", "http://app.example.org", []string{"app.example.org"}, true},
+		{"host matches any port", "https://app.example.org:8443", []string{"app.example.org"}, true},
+		{"host with port", "https://app.example.org:8443", []string{"app.example.org:8443"}, true},
+		{"host with other port", "https://app.example.org:9443", []string{"app.example.org:8443"}, false},
+		{"host with port needs port", "https://app.example.org", []string{"app.example.org:8443"}, false},
+		{"full origin with port", "https://app.example.org:8443", []string{"https://app.example.org:8443"}, true},
+		{"host ignores case", "https://App.Example.org", []string{"app.example.ORG"}, true},
+		{"other host", "https://app.example.org", []string{"api.example.org"}, false},
+		{"wildcard subdomain", "https://app.example.org", []string{"*.example.org"}, true},
+		{"wildcard nested subdomain", "https://a.b.example.org", []string{"*.example.org"}, true},
+		{"wildcard excludes domain", "https://example.org", []string{"*.example.org"}, false},
+		{"wildcard needs dot", "https://badexample.org", []string{"*.example.org"}, false},
+		{"wildcard with scheme", "https://app.example.org", []string{"https://*.example.org"}, true},
+		{"wildcard with wrong scheme", "http://app.example.org", []string{"https://*.example.org"}, false},
+		{"suffix is not a subdomain", "https://example.org.evil.net", []string{"*.example.org"}, false},
+		{"second pattern", "https://app.example.org", []string{"other.example.org", "app.example.org"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wsServer := &wsserver{AllowedOrigins: test.allowed}
+			req := httptest.NewRequest(http.MethodGet, "http://server.example.com/ws", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+
+			if got := wsServer.checkOrigin(req); got != test.want {
+				t.Errorf("checkOrigin with Origin %q and AllowedOrigins %q = %t, want %t", test.origin, test.allowed, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOriginOverride(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"accepted cross origin", "https://trusted.example.net", true},
+		{"rejected same origin", "http://server.example.com", false},
+		{"rejected missing origin", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wsServer := &wsserver{
+				// CheckOrigin replaces AllowedOrigins and the same-origin rule entirely
+				AllowedOrigins: []string{"*"},
+				CheckOrigin: func(req *http.Request) bool {
+					return req.Header.Get("Origin") == "https://trusted.example.net"
+				},
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://server.example.com/ws", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+
+			if got := wsServer.checkOrigin(req); got != test.want {
+				t.Errorf("checkOrigin with Origin %q = %t, want %t", test.origin, got, test.want)
+			}
+		})
+	}
+}
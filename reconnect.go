@@ -0,0 +1,213 @@
+package suede
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectDelay      = time.Second
+	defaultMaxReconnectDelay   = 30 * time.Second
+	defaultReconnectMultiplier = 2
+)
+
+// ReconnectPolicy configures how a client reconnects once its connection to the server is lost.
+// The delay before each attempt grows exponentially, from InitialDelay up to MaxDelay. A client
+// never reconnects after its own call to Close.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay before the first attempt. The zero value waits one second.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between attempts. The zero value caps it at 30 seconds.
+	MaxDelay time.Duration
+	// Multiplier scales the delay after every failed attempt. Values below 1 use 2.
+	Multiplier float64
+	// Jitter randomizes each delay by up to the given fraction in either direction, so that many
+	// clients do not reconnect to a recovering server at once. It is clamped between 0 and 1, and
+	// never takes a delay beyond MaxDelay.
+	Jitter float64
+	// MaxAttempts is the number of attempts made before giving up. Zero retries forever.
+	MaxAttempts int
+	// QueueWhileOffline queues messages sent while the client is reconnecting, and sends them in
+	// order once it has reconnected. Otherwise they fail with ErrConnectionClosed.
+	QueueWhileOffline bool
+	// MaxQueueSize limits how many messages are queued while offline. Zero does not limit them.
+	MaxQueueSize int
+}
+
+// delay returns how long to wait before the given attempt, counting from 1.
+func (policy *ReconnectPolicy) delay(attempt int) time.Duration {
+	initialDelay := policy.InitialDelay
+	if initialDelay <= 0 {
+		initialDelay = defaultReconnectDelay
+	}
+
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultReconnectMultiplier
+	}
+
+	delay := math.Min(float64(initialDelay)*math.Pow(multiplier, float64(attempt-1)), float64(maxDelay))
+
+	// jitter is clamped too, so that delays at the cap only spread below it
+	jitter := math.Max(0, math.Min(policy.Jitter, 1))
+	delay += delay * jitter * (2*rand.Float64() - 1)
+	delay = math.Min(delay, float64(maxDelay))
+
+	return time.Duration(delay)
+}
+
+// queuedMessage is a message sent while the client was offline. fragmentSize is zero unless the
+// message was sent with SendFragmented.
+type queuedMessage struct {
+	messageType  MessageType
+	data         []byte
+	fragmentSize int
+}
+
+// sendOn sends the message on connection, giving up once ctx is done.
+func (message queuedMessage) sendOn(ctx context.Context, connection *WSConnection) error {
+	return connection.send(ctx, message.messageType, message.data, message.fragmentSize)
+}
+
+// reconnect re-establishes a lost connection according to the Reconnect policy. It returns false
+// if the client should stop instead, because it has no policy, it was closed, ctx is done, or
+// every attempt failed.
+func (wsClient *wsclient) reconnect(ctx context.Context) bool {
+	policy := wsClient.Reconnect
+	if policy == nil {
+		return false
+	}
+
+	wsClient.stateMutex.Lock()
+	closed := wsClient.closed
+	stop := wsClient.stop
+	wsClient.stateMutex.Unlock()
+
+	if closed {
+		return false
+	}
+
+	var lastErr error
+	for attempt := 1; policy.MaxAttempts <= 0 || attempt <= policy.MaxAttempts; attempt++ {
+		delay := policy.delay(attempt)
+		if wsClient.OnReconnecting != nil {
+			wsClient.OnReconnecting(attempt, delay)
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+
+		connection, connectionErr := wsClient.handleConnection(ctx)
+		if connectionErr != nil {
+			lastErr = connectionErr
+			continue
+		}
+
+		// a failed flush leaves the rest of the queue for the next attempt
+		if onlineErr := wsClient.goOnline(ctx, connection); onlineErr != nil {
+			connection.drop(CloseNormalClosure, "")
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+			lastErr = onlineErr
+			continue
+		}
+
+		if wsClient.OnReconnect != nil {
+			wsClient.OnReconnect(attempt)
+		}
+
+		return true
+	}
+
+	if wsClient.OnReconnectFailed != nil {
+		wsClient.OnReconnectFailed(lastErr)
+	}
+
+	return false
+}
+
+// goOnline makes connection the client's current connection, first sending any messages queued
+// while offline so that they arrive before newer ones. The client stays offline until the queue is
+// empty, so messages sent meanwhile are queued behind it. The flush is abandoned if ctx is done or
+// the client is closed, and ErrConnectionClosed is returned if the client was closed.
+func (wsClient *wsclient) goOnline(ctx context.Context, connection *WSConnection) error {
+	wsClient.stateMutex.Lock()
+	stop := wsClient.stop
+	wsClient.stateMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	wsClient.stateMutex.Lock()
+	for len(wsClient.queue) > 0 && !wsClient.closed {
+		message := wsClient.queue[0]
+		wsClient.stateMutex.Unlock()
+
+		if sendErr := message.sendOn(ctx, connection); sendErr != nil {
+			return sendErr
+		}
+
+		wsClient.stateMutex.Lock()
+		if len(wsClient.queue) > 0 {
+			wsClient.queue = wsClient.queue[1:]
+		}
+	}
+	defer wsClient.stateMutex.Unlock()
+
+	if wsClient.closed {
+		wsClient.queue = nil
+		return ErrConnectionClosed
+	}
+
+	wsClient.connection = connection
+	wsClient.online = true
+	return nil
+}
+
+// goOffline marks the client as disconnected, so that messages sent before it reconnects are
+// queued if the Reconnect policy allows it.
+func (wsClient *wsclient) goOffline() {
+	wsClient.stateMutex.Lock()
+	defer wsClient.stateMutex.Unlock()
+
+	wsClient.online = false
+}
+
+// enqueue queues a message sent while offline. It must be called while holding stateMutex. Unless
+// the Reconnect policy allows queueing, ErrConnectionClosed is returned.
+func (wsClient *wsclient) enqueue(message queuedMessage) error {
+	policy := wsClient.Reconnect
+	if policy == nil || !policy.QueueWhileOffline || wsClient.closed {
+		return ErrConnectionClosed
+	}
+
+	if policy.MaxQueueSize > 0 && len(wsClient.queue) >= policy.MaxQueueSize {
+		return &WSClientError{message: "Offline message queue is full"}
+	}
+
+	message.data = append([]byte(nil), message.data...)
+	wsClient.queue = append(wsClient.queue, message)
+	return nil
+}
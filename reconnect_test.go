@@ -0,0 +1,121 @@
+package suede
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ReconnectPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"default first attempt", ReconnectPolicy{}, 1, time.Second},
+		{"default doubles", ReconnectPolicy{}, 3, 4 * time.Second},
+		{"default cap", ReconnectPolicy{}, 10, 30 * time.Second},
+		{"custom delays", ReconnectPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 3}, 3, 900 * time.Millisecond},
+		{"custom cap", ReconnectPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 3}, 4, time.Second},
+		{"multiplier below 1", ReconnectPolicy{InitialDelay: time.Second, Multiplier: 0.5}, 2, 2 * time.Second},
+		{"multiplier of 1", ReconnectPolicy{InitialDelay: time.Second, Multiplier: 1}, 5, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delay := test.policy.delay(test.attempt); delay != test.want {
+				t.Errorf("delay(%d) = %s, want %s", test.attempt, delay, test.want)
+			}
+		})
+	}
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ReconnectPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{"below the cap", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}, 2, time.Second, 3 * time.Second},
+		{"near the cap", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}, 4, 4 * time.Second, 10 * time.Second},
+		{"at the cap", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}, 10, 5 * time.Second, 10 * time.Second},
+		{"jitter above 1", ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 3}, 1, 0, 2 * time.Second},
+		{"negative jitter", ReconnectPolicy{InitialDelay: time.Second, Jitter: -1}, 1, time.Second, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				if delay := test.policy.delay(test.attempt); delay < test.min || delay > test.max {
+					t.Fatalf("delay(%d) = %s, want between %s and %s", test.attempt, delay, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectFlushesQueueInOrder(t *testing.T) {
+	server := newTestServer(t, nil)
+	reconnected := make(chan int, 1)
+	client := newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.Reconnect = &ReconnectPolicy{
+			InitialDelay:      10 * time.Millisecond,
+			QueueWhileOffline: true,
+		}
+		// the client is offline until OnDisconnect returns and it starts reconnecting, so these
+		// messages are always queued
+		wsClient.OnDisconnect = func(code CloseCode, reason string) {
+			for _, data := range []string{"one", "two", "three"} {
+				wsClient.SendText([]byte(data))
+			}
+		}
+		wsClient.OnReconnect = func(attempt int) {
+			reconnected <- attempt
+		}
+	})
+
+	// lose the connection without a closing handshake
+	client.currentConnection().conn.Close()
+	receive(t, reconnected, "reconnection")
+	client.SendText([]byte("four"))
+
+	for _, want := range []string{"one", "two", "three", "four"} {
+		if received := receive(t, server.messages, "server message"); string(received) != want {
+			t.Errorf("server received %q, want %q", received, want)
+		}
+	}
+}
+
+func TestCloseDuringHandshakeStopsKeepalive(t *testing.T) {
+	var wsClient *wsclient
+	server := newTestServer(t, func(wsServer *wsserver) {
+		// close the client while it is still waiting for the handshake response
+		wsServer.Authenticate = func(req *http.Request) (any, error) {
+			wsClient.Close(CloseNormalClosure, "")
+			return nil, nil
+		}
+	})
+
+	wsClient, _ = WebSocket(server.httpServer.URL)
+	wsClient.PingInterval = 10 * time.Millisecond
+	wsClient.PongTimeout = 30 * time.Millisecond
+	errs := make(chan error, 1)
+	wsClient.OnError = func(err error) {
+		errs <- err
+	}
+
+	var wg sync.WaitGroup
+	if connectErr := wsClient.Connect(&wg); connectErr != ErrConnectionClosed {
+		t.Fatalf("Connect returned %v, want ErrConnectionClosed", connectErr)
+	}
+
+	// the dropped connection is never read, so a running keepalive would report a pong timeout
+	select {
+	case err := <-errs:
+		t.Errorf("OnError received %s for a connection which never went online", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
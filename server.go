@@ -1,12 +1,16 @@
 package suede
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type WSServerError struct {
@@ -17,16 +21,123 @@ func (err *WSServerError) Error() string {
 	return err.message
 }
 
+// WSAuthError is returned by an Authenticate hook to reject an upgrade request with a particular
+// HTTP response. StatusCode defaults to 401 Unauthorized, and Header is added to the response, for
+// example to send a WWW-Authenticate challenge. Message is sent as the response body, defaulting
+// to the status text.
+type WSAuthError struct {
+	StatusCode int
+	Header     http.Header
+	Message    string
+}
+
+func (err *WSAuthError) Error() string {
+	if err.Message == "" {
+		return http.StatusText(err.status())
+	}
+
+	return err.Message
+}
+
+func (err *WSAuthError) status() int {
+	if err.StatusCode == 0 {
+		return http.StatusUnauthorized
+	}
+
+	return err.StatusCode
+}
+
 type wsserver struct {
-	Host         uint16
-	Path         string
-	OnConnect    func()
-	OnDisconnect func()
-	OnMessage    func([]byte)
+	Host uint16
+	Path string
+	// TLSConfig is used by StartTLS, and may provide certificates in place of certificate files.
+	TLSConfig *tls.Config
+	// Subprotocols lists the subprotocols the server supports, in order of preference. The first
+	// of these offered by a client is selected.
+	Subprotocols []string
+	// SelectSubprotocol, if set, is used instead of Subprotocols to choose one of the subprotocols
+	// offered by a client. Returning an empty string selects no subprotocol.
+	SelectSubprotocol func(req *http.Request, offered []string) string
+	// AllowedOrigins lists the origins, besides the server's own, which browsers may connect from.
+	// Entries are full origins such as "https://example.com", hosts such as "example.com", hosts
+	// with a wildcard subdomain such as "*.example.com", or "*" to allow every origin. Requests
+	// from any other origin are rejected with 403 Forbidden, as is "Origin: null", sent by sandboxed
+	// pages and local files, which only CheckOrigin can accept.
+	AllowedOrigins []string
+	// CheckOrigin, if set, is used instead of AllowedOrigins to decide whether to accept a request,
+	// and must return true for requests which should be upgraded.
+	CheckOrigin func(req *http.Request) bool
+	// Authenticate, if set, is called before a request is upgraded, and may inspect its headers,
+	// cookies, query parameters or TLS client certificates. Returning an error rejects the request,
+	// with the response described by a *WSAuthError, or 401 Unauthorized for any other error.
+	// Otherwise the returned identity is attached to the connection, and available from Identity.
+	Authenticate func(req *http.Request) (any, error)
+	// ResponseHeader holds additional headers to send in every 101 Switching Protocols response,
+	// such as cookies or diagnostics. ResponseHeaderFunc, if set, is called for each request, and
+	// the headers it returns replace those of the same name in ResponseHeader. The headers written
+	// by the handshake itself cannot be set, except for Sec-WebSocket-Protocol, which selects one of
+	// the subprotocols offered by the client in place of Subprotocols and SelectSubprotocol. Invalid
+	// headers fail the upgrade with 500 Internal Server Error.
+	ResponseHeader     http.Header
+	ResponseHeaderFunc func(req *http.Request) http.Header
+	// Compression, if set, accepts permessage-deflate compression when a client offers it.
+	Compression *CompressionOptions
+	// Extensions lists additional extensions the server supports. Each client offer is matched
+	// against them in the order the client sent its offers.
+	Extensions []ExtensionFactory
+	// PingInterval, if set, pings every client at that interval to keep its connection alive. If
+	// no pong arrives within PongTimeout, which defaults to PingInterval, the client is dropped and
+	// OnDisconnect reports CloseAbnormalClosure.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// MaxFrameSize and MaxMessageSize limit the size of frames and messages received from clients,
+	// where zero means no limit. Compressed messages are limited by their decompressed size. A
+	// larger frame or message fails the connection with CloseMessageTooBig.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	// HandshakeTimeout limits how long a client may take to send its upgrade request, and how long
+	// the 101 response may take to write. The request is only limited when the server is started,
+	// as a mounted handler relies on its http.Server's own timeouts. ReadTimeout limits how long to
+	// wait for each frame from a client, so that idle or trickling clients are dropped; PingInterval
+	// should be shorter, so that pongs keep quiet connections open. WriteTimeout limits how long
+	// each frame may take to send. Zero disables a timeout, and any that expires returns or reports
+	// a *WSTimeoutError.
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	OnConnect        func(*WSConnection)
+	// OnDisconnect receives the close status sent by the client, or CloseAbnormalClosure if the
+	// connection was lost without a closing handshake.
+	OnDisconnect func(*WSConnection, CloseCode, string)
+	OnMessage    func(*WSConnection, []byte)
+	// OnTypedMessage is called alongside OnMessage, and also receives whether the message was
+	// sent as text or binary data.
+	OnTypedMessage func(*WSConnection, MessageType, []byte)
+	// OnPing receives the payload of each ping sent by a client, after the pong echoing it has
+	// been sent.
+	OnPing func(*WSConnection, []byte)
+	// OnPong receives the payload of each pong sent by a client, and the round-trip time of the
+	// ping it answers. Unsolicited pongs have a latency of zero.
+	OnPong func(*WSConnection, []byte, time.Duration)
+	// OnError is called with the error whenever a connection fails because the client broke the
+	// protocol, sent a message which is too big, timed out, or the connection broke unexpectedly.
+	OnError func(*WSConnection, error)
+
+	clientsMutex sync.RWMutex
+	clients      []*WSConnection
+
+	// stateMutex guards the server lifecycle below. connections tracks every running read loop so
+	// that Shutdown can wait for clients to drain.
+	stateMutex   sync.Mutex
 	active       bool
-	clients      []*net.Conn
+	shuttingDown bool
+	httpServer   *http.Server
+	stopped      chan struct{}
+	connections  sync.WaitGroup
 }
 
+// WebSocketServer creates a WebSocket server which listens on port, accepting connections at path
+// once started with Start, Run or RunCallback.
 func WebSocketServer(port uint16, path string) (*wsserver, error) {
 	wsServer := &wsserver{
 		Host:   port,
@@ -37,16 +148,95 @@ func WebSocketServer(port uint16, path string) (*wsserver, error) {
 	return wsServer, nil
 }
 
+// WebSocketHandler creates a WebSocket server which does not own a listener. The server is an
+// http.Handler, and is mounted on an existing router or http.Server rather than started.
+func WebSocketHandler() (*wsserver, error) {
+	return WebSocketServer(0, "")
+}
+
+// Upgrade completes the WebSocket handshake for a single request, returning the upgraded
+// connection. Unlike connections accepted by a server, the caller is responsible for reading from
+// the connection with ReadMessage. Only same-origin browser requests are accepted; requests from
+// other origins are rejected with 403 Forbidden. To allow other origins, or to set limits and
+// timeouts, configure a server with WebSocketHandler and call its Upgrade method instead.
+func Upgrade(res http.ResponseWriter, req *http.Request) (*WSConnection, error) {
+	wsServer, _ := WebSocketHandler()
+	return wsServer.Upgrade(res, req)
+}
+
+// Upgrade completes the WebSocket handshake for a single request using the server's configuration,
+// returning the upgraded connection. The origin policy, Authenticate hook, subprotocols,
+// extensions, size limits, timeouts and keepalive all apply, and OnError, OnPing and OnPong are
+// called for the connection. The caller is responsible for reading from the connection with
+// ReadMessage. The connection is not one of the server's Clients, so OnConnect and OnDisconnect are
+// not called, and Shutdown does not close it.
+func (wsServer *wsserver) Upgrade(res http.ResponseWriter, req *http.Request) (*WSConnection, error) {
+	connection, upgradeErr := wsServer.upgrade(res, req)
+	if upgradeErr != nil {
+		return nil, upgradeErr
+	}
+
+	wsServer.attachCallbacks(connection)
+	connection.startKeepalive(wsServer.PingInterval, wsServer.PongTimeout)
+	return connection, nil
+}
+
 // Start spins up the WebSocket server entry point in a new goroutine, returning control to the
 // caller. A sync.WaitGroup is required and must be handled by the caller in the calling function.
 // If wg.Wait() is not called in the calling function, the WebSocket server will exit immediately.
+// The WaitGroup is released once the server is stopped by Close or Shutdown.
 //
 // If the caller does not need to regain control, consider calling Run or RunCallback instead.
 func (wsServer *wsserver) Start(wg *sync.WaitGroup) {
-	http.HandleFunc(wsServer.Path, wsServer.runServer)
-	wg.Add(1)
-	go http.ListenAndServe(":"+fmt.Sprintf("%d", wsServer.Host), nil)
+	wsServer.start(wg, func(httpServer *http.Server) error {
+		return httpServer.ListenAndServe()
+	})
+}
+
+// StartTLS behaves like Start, but serves wss:// connections over TLS. The certificate and key are
+// loaded from certFile and keyFile, which may be left empty if TLSConfig already provides a
+// certificate.
+func (wsServer *wsserver) StartTLS(wg *sync.WaitGroup, certFile string, keyFile string) {
+	wsServer.start(wg, func(httpServer *http.Server) error {
+		return httpServer.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+func (wsServer *wsserver) start(wg *sync.WaitGroup, serve func(*http.Server) error) {
+	mux := http.NewServeMux()
+	mux.Handle(wsServer.Path, wsServer)
+
+	wsServer.stateMutex.Lock()
+	wsServer.httpServer = &http.Server{
+		Addr:              ":" + fmt.Sprintf("%d", wsServer.Host),
+		Handler:           mux,
+		TLSConfig:         wsServer.TLSConfig,
+		ReadHeaderTimeout: wsServer.HandshakeTimeout,
+		// WebSocket upgrades require HTTP/1.1, so HTTP/2 is never offered over TLS
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	wsServer.stopped = make(chan struct{})
+	wsServer.shuttingDown = false
 	wsServer.active = true
+	httpServer := wsServer.httpServer
+	stopped := wsServer.stopped
+	wsServer.stateMutex.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		serveErr := serve(httpServer)
+		if serveErr == http.ErrServerClosed {
+			<-stopped
+			return
+		}
+
+		fmt.Printf("Server error: %s\n", serveErr.Error())
+		wsServer.stateMutex.Lock()
+		wsServer.active = false
+		wsServer.stateMutex.Unlock()
+	}()
 }
 
 // RunCallback spins up the WebSocket server and runs the handler function passed as an argument.
@@ -75,43 +265,183 @@ func (wsServer *wsserver) Run() {
 	wsServer.RunCallback(nil)
 }
 
+// Serve spins up the WebSocket server and does not return control to the caller until ctx is done
+// or the server stops. Once ctx is done, the server shuts down, closing every client with
+// CloseGoingAway and waiting up to five seconds for them to disconnect. Serve returns ctx.Err() in
+// that case, or the error which stopped the listener otherwise.
+func (wsServer *wsserver) Serve(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var serveErr error
+	wsServer.start(&wg, func(httpServer *http.Server) error {
+		serveErr = httpServer.ListenAndServe()
+		return serveErr
+	})
+
+	served := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+		if serveErr == http.ErrServerClosed {
+			return nil
+		}
+		return serveErr
+
+	case <-ctx.Done():
+	}
+
+	shutdownErr := wsServer.Close()
+	<-served
+	if shutdownErr != nil {
+		return shutdownErr
+	}
+
+	return ctx.Err()
+}
+
 func (wsServer *wsserver) IsActive() bool {
+	wsServer.stateMutex.Lock()
+	defer wsServer.stateMutex.Unlock()
+
 	return wsServer.active
 }
 
-func (wsServer *wsserver) Clients() []*net.Conn {
-	return wsServer.clients
+// Clients returns a snapshot of the currently connected clients.
+func (wsServer *wsserver) Clients() []*WSConnection {
+	wsServer.clientsMutex.RLock()
+	defer wsServer.clientsMutex.RUnlock()
+
+	clients := make([]*WSConnection, len(wsServer.clients))
+	copy(clients, wsServer.clients)
+	return clients
 }
 
-func (wsServer *wsserver) runServer(res http.ResponseWriter, req *http.Request) {
+// ServeHTTP upgrades req to a WebSocket connection, and serves it until the client disconnects.
+// This allows the server to be mounted on any router, or behind any middleware, in place of
+// calling Start.
+func (wsServer *wsserver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	wsServer.stateMutex.Lock()
+	if wsServer.shuttingDown {
+		wsServer.stateMutex.Unlock()
+		http.Error(res, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	wsServer.connections.Add(1)
+	wsServer.stateMutex.Unlock()
+	defer wsServer.connections.Done()
+
+	// a failed upgrade has already been answered with an HTTP error, or its connection closed. It is
+	// not logged, as any client could otherwise flood the output with rejected requests
 	connection, connectionErr := wsServer.handleConnection(res, req)
 	if connectionErr != nil {
-		panic("Connection failed")
+		return
 	}
 
-	wsServer.readFromConnection(connection)
-
-	closeErr := (*connection).Close()
-	if closeErr != nil {
-		panic("Failed to close connection")
-	}
+	closeStatus := wsServer.readFromConnection(connection)
 
+	wsServer.clientsMutex.Lock()
 	for i := range wsServer.clients {
 		if wsServer.clients[i] == connection {
 			wsServer.clients = append(wsServer.clients[:i], wsServer.clients[i+1:]...)
 			break
 		}
 	}
-	connection = nil
+	wsServer.clientsMutex.Unlock()
 
 	if wsServer.OnDisconnect != nil {
-		wsServer.OnDisconnect()
+		wsServer.OnDisconnect(connection, closeStatus.Code, closeStatus.Reason)
+	}
+}
+
+// handleConnection upgrades the connection and registers it as a client of the server.
+func (wsServer *wsserver) handleConnection(res http.ResponseWriter, req *http.Request) (*WSConnection, error) {
+	connection, upgradeErr := wsServer.upgrade(res, req)
+	if upgradeErr != nil {
+		return nil, upgradeErr
+	}
+
+	// Shutdown may have started while the request was being upgraded, after its clients were
+	// sent close frames, so the connection is dropped rather than served
+	wsServer.stateMutex.Lock()
+	if wsServer.shuttingDown {
+		wsServer.stateMutex.Unlock()
+		connection.drop(CloseGoingAway, "Server shutting down")
+		return nil, &WSServerError{message: "Server shutting down"}
+	}
+	wsServer.clientsMutex.Lock()
+	wsServer.clients = append(wsServer.clients, connection)
+	wsServer.clientsMutex.Unlock()
+	wsServer.stateMutex.Unlock()
+
+	wsServer.attachCallbacks(connection)
+	if wsServer.OnConnect != nil {
+		wsServer.OnConnect(connection)
+	}
+
+	connection.startKeepalive(wsServer.PingInterval, wsServer.PongTimeout)
+	return connection, nil
+}
+
+// attachCallbacks passes the connection's errors, pings and pongs to the server's callbacks.
+func (wsServer *wsserver) attachCallbacks(connection *WSConnection) {
+	if wsServer.OnPing != nil {
+		connection.keepalive.onPing = func(payload []byte) {
+			wsServer.OnPing(connection, payload)
+		}
+	}
+
+	if wsServer.OnError != nil {
+		connection.onError = func(err error) {
+			wsServer.OnError(connection, err)
+		}
+	}
+
+	if wsServer.OnPong != nil {
+		connection.keepalive.onPong = func(payload []byte, latency time.Duration) {
+			wsServer.OnPong(connection, payload, latency)
+		}
 	}
 }
 
-func (wsServer *wsserver) handleConnection(res http.ResponseWriter, req *http.Request) (*net.Conn, error) {
-	if req.Header.Get("Upgrade") != "websocket" {
-		return nil, &WSServerError{message: "Request header not requesting websocket upgrade"}
+// upgrade completes the WebSocket handshake and hijacks the underlying connection. Requests which
+// are not valid WebSocket handshakes are answered with an HTTP error, and an error is returned.
+func (wsServer *wsserver) upgrade(res http.ResponseWriter, req *http.Request) (*WSConnection, error) {
+	if status, message := validateUpgradeRequest(req); status != 0 {
+		if status == http.StatusUpgradeRequired {
+			res.Header().Set("Upgrade", "websocket")
+			res.Header().Set("Sec-WebSocket-Version", "13")
+		}
+
+		if status == http.StatusMethodNotAllowed {
+			res.Header().Set("Allow", http.MethodGet)
+		}
+
+		http.Error(res, message, status)
+		return nil, &WSServerError{message: message}
+	}
+
+	if !wsServer.checkOrigin(req) {
+		http.Error(res, "Origin not allowed", http.StatusForbidden)
+		return nil, &WSServerError{message: fmt.Sprintf("Origin %q not allowed", req.Header.Get("Origin"))}
+	}
+
+	var identity any
+	if wsServer.Authenticate != nil {
+		var authErr error
+		identity, authErr = wsServer.Authenticate(req)
+		if authErr != nil {
+			rejectUnauthenticated(res, authErr)
+			return nil, authErr
+		}
+	}
+
+	responseHeader, subprotocol, headerErr := wsServer.responseHeader(req)
+	if headerErr != nil {
+		http.Error(res, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, headerErr
 	}
 
 	wsKey := req.Header.Get("Sec-WebSocket-Key")
@@ -119,164 +449,322 @@ func (wsServer *wsserver) handleConnection(res http.ResponseWriter, req *http.Re
 
 	hijacker, ok := res.(http.Hijacker)
 	if !ok {
+		http.Error(res, "WebSocket upgrade not supported", http.StatusInternalServerError)
 		return nil, &WSServerError{message: "Failed to hijack the connection"}
 	}
 
-	connection, _, _ := hijacker.Hijack()
-	wsServer.clients = append(wsServer.clients, &connection)
+	conn, bufferedConnection, hijackErr := hijacker.Hijack()
+	if hijackErr != nil {
+		http.Error(res, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return nil, hijackErr
+	}
+
+	extensionResponse, extensions := wsServer.negotiateExtensions(req)
 
 	var content []byte
 	content = append(content, "HTTP/1.1 101 Switching Protocols\r\n"...)
 	content = append(content, "Upgrade: websocket\r\n"...)
 	content = append(content, "Connection: Upgrade\r\n"...)
-	content = append(content, fmt.Sprintf("Sec-WebSocket-Accept: %s", wsAccept)...)
-	content = append(content, "\r\n\r\n"...)
-	connection.Write(content)
+	content = append(content, fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", wsAccept)...)
+	if subprotocol != "" {
+		content = append(content, fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", subprotocol)...)
+	}
+	if extensionResponse != "" {
+		content = append(content, fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", extensionResponse)...)
+	}
+	var extraHeaders strings.Builder
+	responseHeader.Write(&extraHeaders)
+	content = append(content, extraHeaders.String()...)
+	content = append(content, "\r\n"...)
 
-	if wsServer.OnConnect != nil {
-		wsServer.OnConnect()
+	if wsServer.HandshakeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(wsServer.HandshakeTimeout))
 	}
 
-	return &connection, nil
-}
+	if _, writeErr := conn.Write(content); writeErr != nil {
+		conn.Close()
+		if errors.Is(writeErr, os.ErrDeadlineExceeded) {
+			return nil, &WSTimeoutError{Op: "handshake", Duration: wsServer.HandshakeTimeout}
+		}
+		return nil, writeErr
+	}
 
-func (wsServer *wsserver) readFromConnection(connection *net.Conn) {
-	readBuffer := make([]byte, 256)
+	// the hijacked connection may carry deadlines set by the http.Server
+	conn.SetDeadline(time.Time{})
 
-ReadForever:
-	for true {
-		bytesRead, readErr := (*connection).Read(readBuffer)
-		if readErr != nil {
-			if readErr == io.EOF {
-				fmt.Println("Client disconnected")
-			} else {
-				fmt.Printf("Read Error: %s\n", readErr.Error())
-			}
+	connectionID := atomic.AddUint64(&connectionIDs, 1)
+	connection := newWSConnection(connectionID, conn, bufferedConnection.Reader, req, false)
+	connection.subprotocol = subprotocol
+	connection.identity = identity
+	connection.useExtensions(extensions)
+	connection.setSizeLimits(wsServer.MaxFrameSize, wsServer.MaxMessageSize)
+	connection.setTimeouts(wsServer.ReadTimeout, wsServer.WriteTimeout)
 
-			break ReadForever
-		}
+	return connection, nil
+}
 
-		if bytesRead < 2 {
-			fmt.Println("Not enough bytes for a frame")
-			continue
+// responseHeader builds the additional headers for the 101 response to req, and selects the
+// subprotocol to use. The headers are validated so that they cannot break the handshake.
+func (wsServer *wsserver) responseHeader(req *http.Request) (http.Header, string, error) {
+	header := make(http.Header)
+	for name, values := range wsServer.ResponseHeader {
+		header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	if wsServer.ResponseHeaderFunc != nil {
+		for name, values := range wsServer.ResponseHeaderFunc(req) {
+			header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
 		}
+	}
 
-		controlByte := readBuffer[0]
-		opCode := controlByte & 0b00001111
-		switch opCode {
-		case 0x8:
-			break ReadForever
+	var subprotocol string
+	if chosen, ok := header["Sec-Websocket-Protocol"]; ok {
+		header.Del("Sec-Websocket-Protocol")
+		if len(chosen) != 1 || !offeredSubprotocol(req, chosen[0]) {
+			return nil, "", &WSServerError{message: "Response header Sec-WebSocket-Protocol must be one subprotocol offered by the client"}
+		}
+		subprotocol = chosen[0]
+	} else {
+		subprotocol = wsServer.selectSubprotocol(req)
+	}
 
-		case 0x9:
-			// ping
-			fmt.Println("got a ping, sending a pong")
-			wsServer.pong(connection)
-			continue
+	if validateErr := validateResponseHeader(header); validateErr != nil {
+		return nil, "", validateErr
+	}
 
-		case 0xA:
-			// pong
-			fmt.Println("got a pong")
-			continue
+	return header, subprotocol, nil
+}
 
-		default:
+// offeredSubprotocol reports whether the client offered subprotocol in req. Subprotocol names are
+// case sensitive.
+func offeredSubprotocol(req *http.Request, subprotocol string) bool {
+	for _, offered := range headerTokens(req.Header, "Sec-WebSocket-Protocol") {
+		if offered == subprotocol {
+			return true
 		}
+	}
 
-		payloadInfoByte := readBuffer[1]
-		mask := payloadInfoByte & 0b10000000
-		if mask == 0 {
-			fmt.Println("Client should set mask bit")
-			break
+	return false
+}
+
+// rejectUnauthenticated answers a request rejected by Authenticate. Only a *WSAuthError chooses
+// the response; the text of any other error is not sent, as it may describe server internals.
+func rejectUnauthenticated(res http.ResponseWriter, authErr error) {
+	var rejection *WSAuthError
+	if !errors.As(authErr, &rejection) {
+		rejection = &WSAuthError{}
+	}
+
+	for name, values := range rejection.Header {
+		for _, value := range values {
+			res.Header().Add(name, value)
 		}
+	}
 
-		payloadLength := payloadInfoByte & 0b01111111
+	http.Error(res, rejection.Error(), rejection.status())
+}
 
-		data := make([]byte, 0, payloadLength)
-		switch {
-		case payloadLength < 126:
-			maskValue := readBuffer[2:6]
-			data = wsServer.readFrameData(connection, maskValue, readBuffer[6:], uint64(payloadLength))
+// negotiateExtensions accepts the client's extension offers which the server supports, returning
+// the Sec-WebSocket-Extensions response header value and the accepted extensions. Each extension
+// is accepted at most once, and never alongside another extension using the same reserved bits.
+func (wsServer *wsserver) negotiateExtensions(req *http.Request) (string, []Extension) {
+	available := newExtensions(wsServer.Compression, wsServer.Extensions)
+	if len(available) == 0 {
+		return "", nil
+	}
 
-		case payloadLength == 126:
-			sizeBytes := []byte{readBuffer[2], readBuffer[3]}
-			maskValue := readBuffer[4:8]
-			payloadLength16 := binary.BigEndian.Uint16(sizeBytes)
-			data = wsServer.readFrameData(connection, maskValue, readBuffer[8:], uint64(payloadLength16))
+	var accepted []Extension
+	var responses []string
+	var usedBits byte
+	for _, offer := range parseExtensions(req.Header) {
+		for index, extension := range available {
+			if extension == nil || extension.Name() != offer.name || extension.ReservedBits()&usedBits != 0 {
+				continue
+			}
 
-		case payloadLength == 127:
-			sizeBytes := []byte{
-				readBuffer[2], readBuffer[3], readBuffer[4], readBuffer[5],
-				readBuffer[6], readBuffer[7], readBuffer[8], readBuffer[9],
+			params, ok := extension.Negotiate(offer.params)
+			if !ok {
+				continue
 			}
-			maskValue := readBuffer[10:14]
-			payloadLength64 := binary.BigEndian.Uint64(sizeBytes)
-			data = wsServer.readFrameData(connection, maskValue, readBuffer[14:], uint64(payloadLength64))
-		}
 
-		if wsServer.OnMessage != nil {
-			wsServer.OnMessage(data)
+			accepted = append(accepted, extension)
+			responses = append(responses, extensionOffer{name: offer.name, params: params}.String())
+			usedBits |= extension.ReservedBits()
+			available[index] = nil
+			break
 		}
 	}
+
+	return strings.Join(responses, ", "), accepted
 }
 
-func (wsServer *wsserver) readFrameData(connection *net.Conn, mask []byte, readBuffer []byte, length uint64) []byte {
-	data := make([]byte, 0, length)
-	for i := 0; i < len(readBuffer); i++ {
-		data = append(data, readBuffer[i]^mask[i%4])
-		if uint64(len(data)) == length {
-			break
-		}
+// selectSubprotocol chooses which of the subprotocols offered in req to use, returning an empty
+// string if none are acceptable.
+func (wsServer *wsserver) selectSubprotocol(req *http.Request) string {
+	offered := headerTokens(req.Header, "Sec-WebSocket-Protocol")
+	if len(offered) == 0 {
+		return ""
 	}
 
-	bytesWritten := uint64(len(data))
-	if length <= bytesWritten {
-		return data
+	if wsServer.SelectSubprotocol != nil {
+		selected := wsServer.SelectSubprotocol(req, offered)
+		for _, subprotocol := range offered {
+			if subprotocol == selected {
+				return selected
+			}
+		}
+
+		return ""
 	}
 
-	bytesRemaining := length - bytesWritten
-	frameBuffer := make([]byte, bytesRemaining)
-	bytesRead, err := (*connection).Read(frameBuffer)
-	if err != nil {
-		fmt.Println("Continutation read err")
-		fmt.Println(err.Error())
+	for _, supported := range wsServer.Subprotocols {
+		for _, subprotocol := range offered {
+			if subprotocol == supported {
+				return supported
+			}
+		}
 	}
 
-	offset := len(data) % 4
-	for i := 0; i < bytesRead; i++ {
-		unmaskedData := frameBuffer[i] ^ mask[(i+offset)%4]
-		data = append(data, unmaskedData)
+	return ""
+}
+
+// readFromConnection delivers messages from the client until the connection closes, returning
+// the status the connection was closed with.
+func (wsServer *wsserver) readFromConnection(connection *WSConnection) *WSCloseError {
+	for true {
+		messageType, data, readErr := connection.readMessage()
+		if readErr != nil {
+			return connection.finishRead(readErr)
+		}
+
+		if wsServer.OnMessage != nil {
+			wsServer.OnMessage(connection, data)
+		}
+
+		if wsServer.OnTypedMessage != nil {
+			wsServer.OnTypedMessage(connection, messageType, data)
+		}
 	}
 
-	return data
+	return nil
 }
 
-func (wsServer *wsserver) Send(connection *net.Conn, data []byte) {
-	payloadLength := len(data)
-	frameLength := payloadLength + 2
-	responsePayload := make([]byte, 0, frameLength)
+// Send writes data to a single connected client as a text message. Payloads longer than 125 bytes
+// are sent using the 16-bit or 64-bit extended payload length encodings.
+func (wsServer *wsserver) Send(connection *WSConnection, data []byte) {
+	wsServer.SendText(connection, data)
+}
+
+// SendText writes data to a single connected client as a text message.
+func (wsServer *wsserver) SendText(connection *WSConnection, data []byte) {
+	wsServer.sendMessage(connection, TextMessage, data)
+}
 
-	// TODO: Handle frames when data length > 125
-	responsePayload = append(responsePayload, 0x81)
-	responsePayload = append(responsePayload, byte(payloadLength))
-	responsePayload = append(responsePayload, data...)
-	(*connection).Write(responsePayload)
+// SendBinary writes data to a single connected client as a binary message.
+func (wsServer *wsserver) SendBinary(connection *WSConnection, data []byte) {
+	wsServer.sendMessage(connection, BinaryMessage, data)
 }
 
+// SendFragmented writes data to a single connected client as one message of the given type, split
+// across multiple frames each carrying at most fragmentSize bytes.
+func (wsServer *wsserver) SendFragmented(connection *WSConnection, messageType MessageType, data []byte, fragmentSize int) {
+	err := connection.SendFragmented(messageType, data, fragmentSize)
+	if err != nil {
+		fmt.Printf("Send error: %s\n", err.Error())
+	}
+}
+
+// Broadcast writes data to every connected client as a text message.
 func (wsServer *wsserver) Broadcast(data []byte) {
-	for _, client := range wsServer.clients {
-		wsServer.Send(client, data)
+	for _, client := range wsServer.Clients() {
+		wsServer.SendText(client, data)
+	}
+}
+
+// BroadcastBinary writes data to every connected client as a binary message.
+func (wsServer *wsserver) BroadcastBinary(data []byte) {
+	for _, client := range wsServer.Clients() {
+		wsServer.SendBinary(client, data)
+	}
+}
+
+func (wsServer *wsserver) sendMessage(connection *WSConnection, messageType MessageType, data []byte) {
+	err := connection.SendMessage(messageType, data)
+	if err != nil {
+		fmt.Printf("Send error: %s\n", err.Error())
 	}
 }
 
-func (wsServer *wsserver) Close() {
-	// TODO: this
+// Close gracefully shuts down the server, waiting up to five seconds for clients to complete the
+// closing handshake. See Shutdown for details.
+func (wsServer *wsserver) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	return wsServer.Shutdown(ctx)
 }
 
-func (wsServer *wsserver) Ping() {
-	for _, client := range wsServer.clients {
-		(*client).Write([]byte{0x89, 0x00})
+// Shutdown gracefully shuts down the server. New upgrade requests are refused, every connected
+// client is sent a close frame with CloseGoingAway, and Shutdown waits for the clients to
+// disconnect before stopping the listener and releasing the WaitGroup passed to Start. If ctx
+// expires first, the remaining connections are dropped and ctx's error is returned at once,
+// without waiting for their read loops to finish.
+func (wsServer *wsserver) Shutdown(ctx context.Context) error {
+	wsServer.stateMutex.Lock()
+	if wsServer.shuttingDown {
+		wsServer.stateMutex.Unlock()
+		return nil
+	}
+	wsServer.shuttingDown = true
+	wsServer.active = false
+	httpServer := wsServer.httpServer
+	stopped := wsServer.stopped
+	wsServer.stateMutex.Unlock()
+
+	// a client which has stopped reading must not hold up the others, or the deadline below
+	for _, client := range wsServer.Clients() {
+		go client.Close(CloseGoingAway, "Server shutting down")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wsServer.connections.Wait()
+		close(drained)
+	}()
+
+	var shutdownErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// closing the network connections also fails any blocked close frames. Connections still
+		// being upgraded drop themselves once they find the server shutting down.
+		for _, client := range wsServer.Clients() {
+			client.conn.Close()
+		}
+		shutdownErr = ctx.Err()
 	}
+
+	if httpServer != nil {
+		if closeErr := httpServer.Shutdown(ctx); closeErr != nil && shutdownErr == nil {
+			shutdownErr = closeErr
+		}
+		close(stopped)
+	}
+
+	return shutdownErr
 }
 
-func (wsServer *wsserver) pong(connection *net.Conn) {
-	(*connection).Write([]byte{0x8A, 0x00})
+// Ping sends a ping carrying payload, which must be at most 125 bytes, to every connected client.
+func (wsServer *wsserver) Ping(payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return &WSServerError{message: "Ping payload exceeds 125 bytes"}
+	}
+
+	for _, client := range wsServer.Clients() {
+		if pingErr := client.Ping(payload); pingErr != nil {
+			fmt.Printf("Ping error: %s\n", pingErr.Error())
+		}
+	}
+
+	return nil
 }
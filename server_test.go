@@ -0,0 +1,345 @@
+package suede
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRejectUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name    string
+		authErr error
+		status  int
+		body    string
+		header  http.Header
+	}{
+		{"plain error", errors.New("database password expired"), http.StatusUnauthorized, "Unauthorized", nil},
+		{"default auth error", &WSAuthError{}, http.StatusUnauthorized, "Unauthorized", nil},
+		{"status only", &WSAuthError{StatusCode: http.StatusForbidden}, http.StatusForbidden, "Forbidden", nil},
+		{"message", &WSAuthError{StatusCode: http.StatusForbidden, Message: "Account suspended"}, http.StatusForbidden, "Account suspended", nil},
+		{"challenge", &WSAuthError{
+			Header: http.Header{"Www-Authenticate": {`Bearer realm="chat"`}},
+		}, http.StatusUnauthorized, "Unauthorized", http.Header{"Www-Authenticate": {`Bearer realm="chat"`}}},
+		{"wrapped auth error", fmt.Errorf("session lookup: %w", &WSAuthError{StatusCode: http.StatusTooManyRequests}), http.StatusTooManyRequests, "Too Many Requests", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			rejectUnauthenticated(recorder, test.authErr)
+
+			if recorder.Code != test.status {
+				t.Errorf("response status %d, want %d", recorder.Code, test.status)
+			}
+			if body := strings.TrimSpace(recorder.Body.String()); body != test.body {
+				t.Errorf("response body %q, want %q", body, test.body)
+			}
+			for name, values := range test.header {
+				if got := recorder.Header().Values(name); strings.Join(got, ",") != strings.Join(values, ",") {
+					t.Errorf("response header %s = %q, want %q", name, got, values)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateRejectsBeforeUpgrade(t *testing.T) {
+	wsServer := &wsserver{
+		Authenticate: func(req *http.Request) (any, error) {
+			return nil, &WSAuthError{StatusCode: http.StatusForbidden}
+		},
+	}
+	recorder := httptest.NewRecorder()
+
+	// the recorder cannot be hijacked, so the request must be rejected before any upgrade is tried
+	if _, upgradeErr := wsServer.upgrade(recorder, upgradeRequest()); upgradeErr == nil {
+		t.Fatalf("upgrade accepted a rejected request")
+	}
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("response status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		static      http.Header
+		perRequest  http.Header
+		offered     string
+		supported   []string
+		header      http.Header
+		subprotocol string
+		valid       bool
+	}{
+		{"none", nil, nil, "", nil, http.Header{}, "", true},
+		{"static", http.Header{"x-server": {"suede"}}, nil, "", nil, http.Header{"X-Server": {"suede"}}, "", true},
+		{"per request replaces static",
+			http.Header{"X-Server": {"suede"}, "X-Region": {"eu"}},
+			http.Header{"x-region": {"us", "ca"}},
+			"", nil,
+			http.Header{"X-Server": {"suede"}, "X-Region": {"us", "ca"}}, "", true},
+		{"subprotocols", nil, nil, "chat, superchat", []string{"superchat", "chat"}, http.Header{}, "superchat", true},
+		{"header selects subprotocol",
+			nil, http.Header{"Sec-WebSocket-Protocol": {"chat"}},
+			"chat, superchat", []string{"superchat"},
+			http.Header{}, "chat", true},
+		{"static header selects subprotocol",
+			http.Header{"Sec-WebSocket-Protocol": {"superchat"}}, nil,
+			"chat, superchat", nil,
+			http.Header{}, "superchat", true},
+		{"subprotocol not offered",
+			nil, http.Header{"Sec-WebSocket-Protocol": {"admin"}},
+			"chat, superchat", nil, nil, "", false},
+		{"subprotocol without offers",
+			nil, http.Header{"Sec-WebSocket-Protocol": {"chat"}},
+			"", nil, nil, "", false},
+		{"several subprotocols",
+			nil, http.Header{"Sec-WebSocket-Protocol": {"chat", "superchat"}},
+			"chat, superchat", nil, nil, "", false},
+		{"subprotocol names are case sensitive",
+			nil, http.Header{"Sec-WebSocket-Protocol": {"Chat"}},
+			"chat", nil, nil, "", false},
+		{"reserved header", nil, http.Header{"Sec-WebSocket-Accept": {"forged"}}, "", nil, nil, "", false},
+		{"invalid value", http.Header{"X-Server": {"suede\r\n"}}, nil, "", nil, nil, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wsServer := &wsserver{
+				ResponseHeader: test.static,
+				Subprotocols:   test.supported,
+			}
+			if test.perRequest != nil {
+				wsServer.ResponseHeaderFunc = func(req *http.Request) http.Header {
+					return test.perRequest
+				}
+			}
+			req := upgradeRequest()
+			if test.offered != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", test.offered)
+			}
+
+			header, subprotocol, headerErr := wsServer.responseHeader(req)
+			if !test.valid {
+				if headerErr == nil {
+					t.Errorf("responseHeader accepted %q", header)
+				}
+				return
+			}
+
+			if headerErr != nil {
+				t.Fatalf("responseHeader: %s", headerErr)
+			}
+			if subprotocol != test.subprotocol {
+				t.Errorf("selected subprotocol %q, want %q", subprotocol, test.subprotocol)
+			}
+			if fmt.Sprint(header) != fmt.Sprint(test.header) {
+				t.Errorf("response header %q, want %q", header, test.header)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderLeavesConfigurationUnchanged(t *testing.T) {
+	static := http.Header{"Sec-Websocket-Protocol": {"chat"}, "X-Server": {"suede"}}
+	wsServer := &wsserver{ResponseHeader: static}
+	req := upgradeRequest()
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+
+	header, _, _ := wsServer.responseHeader(req)
+	header.Set("X-Server", "changed")
+
+	if len(static) != 2 || static.Get("X-Server") != "suede" {
+		t.Errorf("ResponseHeader changed to %q", static)
+	}
+}
+
+func TestUpgradeMethodAppliesConfiguration(t *testing.T) {
+	wsServer, _ := WebSocketHandler()
+	wsServer.AllowedOrigins = []string{"https://app.example.org"}
+	wsServer.MaxMessageSize = 100
+	readErrs := make(chan error, 1)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		upgrade := Upgrade
+		if req.URL.Path == "/configured" {
+			upgrade = wsServer.Upgrade
+		}
+
+		connection, upgradeErr := upgrade(res, req)
+		if upgradeErr != nil {
+			return
+		}
+
+		_, _, readErr := connection.ReadMessage()
+		readErrs <- readErr
+	}))
+	defer httpServer.Close()
+
+	dial := func(path string) (*wsclient, *sync.WaitGroup, error) {
+		wsClient, _ := WebSocket(httpServer.URL + path)
+		wsClient.Header = http.Header{"Origin": {"https://app.example.org"}}
+		var wg sync.WaitGroup
+		return wsClient, &wg, wsClient.Connect(&wg)
+	}
+
+	var handshakeErr *WSHandshakeError
+	if _, _, connectErr := dial("/default"); !errors.As(connectErr, &handshakeErr) || handshakeErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Upgrade accepted cross-origin request with %v, want 403 Forbidden", connectErr)
+	}
+
+	wsClient, wg, connectErr := dial("/configured")
+	if connectErr != nil {
+		t.Fatalf("server Upgrade rejected an allowed origin: %s", connectErr)
+	}
+	defer wg.Wait()
+
+	wsClient.SendBinary(make([]byte, 200))
+	var closeErr *WSCloseError
+	if readErr := receive(t, readErrs, "read error"); !errors.As(readErr, &closeErr) || closeErr.Code != CloseMessageTooBig {
+		t.Errorf("ReadMessage returned %v, want CloseMessageTooBig", readErr)
+	}
+}
+
+// freePort returns a TCP port which was free when checked, for servers which own their listener.
+func freePort(t *testing.T) uint16 {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Listen: %s", listenErr)
+	}
+	defer listener.Close()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// startServer starts wsServer and waits until it accepts connections.
+func startServer(t *testing.T, wsServer *wsserver, start func()) {
+	start()
+
+	address := fmt.Sprintf("127.0.0.1:%d", wsServer.Host)
+	deadline := time.Now().Add(testTimeout)
+	for true {
+		conn, dialErr := net.Dial("tcp", address)
+		if dialErr == nil {
+			conn.Close()
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("server never started listening: %s", dialErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	wsServer, _ := WebSocketServer(freePort(t), "/ws")
+	serverDisconnects := make(chan CloseCode, 1)
+	wsServer.OnDisconnect = func(connection *WSConnection, code CloseCode, reason string) {
+		serverDisconnects <- code
+	}
+	var serverWG sync.WaitGroup
+	startServer(t, wsServer, func() { wsServer.Start(&serverWG) })
+
+	if !wsServer.IsActive() {
+		t.Errorf("IsActive reported false once started")
+	}
+
+	wsClient, _ := WebSocket(fmt.Sprintf("ws://127.0.0.1:%d/ws", wsServer.Host))
+	clientDisconnects := make(chan CloseCode, 1)
+	wsClient.OnDisconnect = func(code CloseCode, reason string) {
+		clientDisconnects <- code
+	}
+	var clientWG sync.WaitGroup
+	if connectErr := wsClient.Connect(&clientWG); connectErr != nil {
+		t.Fatalf("Connect: %s", connectErr)
+	}
+	defer clientWG.Wait()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- wsServer.Close()
+	}()
+
+	if closeErr := receive(t, closed, "Close"); closeErr != nil {
+		t.Errorf("Close returned %s", closeErr)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		serverWG.Wait()
+		close(released)
+	}()
+	receive(t, released, "server WaitGroup")
+
+	if wsServer.IsActive() {
+		t.Errorf("IsActive reported true once closed")
+	}
+
+	if code := receive(t, clientDisconnects, "client disconnect"); code != CloseGoingAway {
+		t.Errorf("client disconnected with %d, want %d", code, CloseGoingAway)
+	}
+
+	if code := receive(t, serverDisconnects, "server disconnect"); code != CloseGoingAway {
+		t.Errorf("server saw the client disconnect with %d, want %d", code, CloseGoingAway)
+	}
+}
+
+func TestShutdownStuckClient(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.OnConnect = func(connection *WSConnection) {
+			connected <- struct{}{}
+		}
+	})
+
+	// a client which completes the handshake, then never reads or replies to the close frame
+	conn, dialErr := net.Dial("tcp", server.httpServer.Listener.Addr().String())
+	if dialErr != nil {
+		t.Fatalf("Dial: %s", dialErr)
+	}
+	defer conn.Close()
+
+	req := upgradeRequest()
+	req.Host = server.httpServer.Listener.Addr().String()
+	req.RequestURI = ""
+	if writeErr := req.Write(conn); writeErr != nil {
+		t.Fatalf("writing handshake: %s", writeErr)
+	}
+	response, readErr := http.ReadResponse(bufio.NewReader(conn), req)
+	if readErr != nil || response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v", readErr)
+	}
+	receive(t, connected, "server connection")
+
+	const deadline = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	if shutdownErr := receive(t, shutdown, "Shutdown"); shutdownErr != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", shutdownErr)
+	}
+	if elapsed := time.Since(start); elapsed < deadline || elapsed > deadline+time.Second {
+		t.Errorf("Shutdown returned after %s, want about %s", elapsed, deadline)
+	}
+
+	if code := receive(t, server.disconnects, "server disconnect"); code != CloseAbnormalClosure {
+		t.Errorf("server saw the client disconnect with %d, want %d", code, CloseAbnormalClosure)
+	}
+}
@@ -0,0 +1,68 @@
+package suede
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// WSTimeoutError is returned, and passed to OnError, when a connection exceeds one of its
+// timeouts. Op is "handshake", "read", "write" or "pong", and Duration is the timeout which
+// was exceeded.
+type WSTimeoutError struct {
+	Op       string
+	Duration time.Duration
+}
+
+func (err *WSTimeoutError) Error() string {
+	return fmt.Sprintf("WebSocket %s timed out after %s", err.Op, err.Duration)
+}
+
+// Timeout always reports true, so that the error can be recognised like a net.Error timeout.
+func (err *WSTimeoutError) Timeout() bool {
+	return true
+}
+
+// reason is the reason reported in OnDisconnect for a connection dropped by this timeout.
+func (err *WSTimeoutError) reason() string {
+	return strings.ToUpper(err.Op[:1]) + err.Op[1:] + " timeout"
+}
+
+// setTimeouts sets the idle read timeout, applied while waiting for each frame, and the write
+// timeout, applied to each frame written. Zero disables either timeout.
+func (connection *WSConnection) setTimeouts(readTimeout time.Duration, writeTimeout time.Duration) {
+	connection.messageReader.readTimeout = readTimeout
+	connection.messageReader.setReadDeadline = connection.conn.SetReadDeadline
+	connection.writeTimeout = writeTimeout
+}
+
+// setWriteDeadline starts the write timeout for the next frame, returning the deadline set, or
+// the zero time if there is no write timeout or interrupted reports that the frame's message has
+// been interrupted.
+func (connection *WSConnection) setWriteDeadline(interrupted *atomic.Bool) time.Time {
+	if connection.writeTimeout <= 0 {
+		return time.Time{}
+	}
+
+	deadline := time.Now().Add(connection.writeTimeout)
+	connection.conn.SetWriteDeadline(deadline)
+	if interrupted != nil && interrupted.Load() {
+		// the interruption may have set its deadline before the one above
+		connection.conn.SetWriteDeadline(pastDeadline)
+		return time.Time{}
+	}
+
+	return deadline
+}
+
+// writeTimedOut abandons a connection whose peer stopped accepting data. The frame may have been
+// partly written, so no close frame can follow it, and the network connection is closed
+// outright. The read loop reports the timeout once it stops.
+func (connection *WSConnection) writeTimedOut() *WSTimeoutError {
+	timeoutErr := &WSTimeoutError{Op: "write", Duration: connection.writeTimeout}
+	connection.writeTimeoutErr.CompareAndSwap(nil, timeoutErr)
+	connection.conn.Close()
+
+	return timeoutErr
+}
@@ -0,0 +1,193 @@
+package suede
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeStatus is a close status reported to OnDisconnect.
+type closeStatus struct {
+	code   CloseCode
+	reason string
+}
+
+// expectTimeout checks that err is a *WSTimeoutError for op and duration.
+func expectTimeout(t *testing.T, err error, op string, duration time.Duration) {
+	t.Helper()
+
+	var timeoutErr *WSTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Op != op || timeoutErr.Duration != duration {
+		t.Errorf("got error %v, want a %s *WSTimeoutError after %s", err, op, duration)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// a server which accepts connections but never answers the handshake
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Listen: %s", listenErr)
+	}
+	defer listener.Close()
+	go func() {
+		for true {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			// held open, unanswered, until the listener is closed
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name             string
+		handshakeTimeout time.Duration
+		ctxTimeout       time.Duration
+		timeout          bool
+	}{
+		{"handshake timeout", 100 * time.Millisecond, 0, true},
+		{"handshake timeout before context", 100 * time.Millisecond, testTimeout, true},
+		{"context before handshake timeout", testTimeout, 100 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wsClient, _ := WebSocket("ws://" + listener.Addr().String())
+			wsClient.HandshakeTimeout = test.handshakeTimeout
+
+			ctx := context.Background()
+			if test.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+
+			var wg sync.WaitGroup
+			dialErr := wsClient.DialContext(ctx, &wg)
+			if test.timeout {
+				expectTimeout(t, dialErr, "handshake", test.handshakeTimeout)
+			} else if dialErr != context.DeadlineExceeded {
+				t.Errorf("DialContext returned %v, want context.DeadlineExceeded", dialErr)
+			}
+		})
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	const readTimeout = 100 * time.Millisecond
+	serverDisconnects := make(chan closeStatus, 1)
+	server := newTestServer(t, func(wsServer *wsserver) {
+		wsServer.ReadTimeout = readTimeout
+		wsServer.OnDisconnect = func(connection *WSConnection, code CloseCode, reason string) {
+			serverDisconnects <- closeStatus{code, reason}
+		}
+	})
+	clientDisconnects := make(chan closeStatus, 1)
+	newTestClient(t, server, func(wsClient *wsclient) {
+		wsClient.OnDisconnect = func(code CloseCode, reason string) {
+			clientDisconnects <- closeStatus{code, reason}
+		}
+	})
+
+	// the client sends nothing, so the server gives up on it
+	expectTimeout(t, receive(t, server.errors, "server error"), "read", readTimeout)
+
+	want := closeStatus{CloseAbnormalClosure, "Read timeout"}
+	if status := receive(t, serverDisconnects, "server disconnect"); status != want {
+		t.Errorf("server OnDisconnect received %v, want %v", status, want)
+	}
+
+	// the client is still sent a close frame saying why
+	want = closeStatus{CloseGoingAway, "Read timeout"}
+	if status := receive(t, clientDisconnects, "client disconnect"); status != want {
+		t.Errorf("client OnDisconnect received %v, want %v", status, want)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		writeTimeout time.Duration
+		ctxTimeout   time.Duration
+		timeout      bool
+	}{
+		{"write timeout", 100 * time.Millisecond, 0, true},
+		{"write timeout before context", 100 * time.Millisecond, testTimeout, true},
+		// the context's earlier deadline interrupts the write, which is not a write timeout
+		{"context before write timeout", testTimeout, 100 * time.Millisecond, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+
+			httpServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				connection, upgradeErr := Upgrade(res, req)
+				if upgradeErr != nil {
+					return
+				}
+				defer connection.conn.Close()
+
+				// never read, so that the client's writes block
+				<-release
+			}))
+			defer httpServer.Close()
+
+			wsClient, _ := WebSocket(httpServer.URL)
+			wsClient.WriteTimeout = test.writeTimeout
+			errs := make(chan error, 1)
+			wsClient.OnError = func(err error) {
+				errs <- err
+			}
+			disconnects := make(chan closeStatus, 1)
+			wsClient.OnDisconnect = func(code CloseCode, reason string) {
+				disconnects <- closeStatus{code, reason}
+			}
+
+			var wg sync.WaitGroup
+			if connectErr := wsClient.Connect(&wg); connectErr != nil {
+				t.Fatalf("Connect: %s", connectErr)
+			}
+			defer wg.Wait()
+			defer wsClient.currentConnection().conn.Close()
+
+			ctx := context.Background()
+			if test.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+
+			sendErr := wsClient.currentConnection().SendContext(ctx, BinaryMessage, make([]byte, 16<<20))
+			status := receive(t, disconnects, "client disconnect")
+
+			if !test.timeout {
+				if sendErr != context.DeadlineExceeded {
+					t.Errorf("SendContext returned %v, want context.DeadlineExceeded", sendErr)
+				}
+				if want := (closeStatus{CloseAbnormalClosure, ""}); status != want {
+					t.Errorf("OnDisconnect received %v, want %v", status, want)
+				}
+				select {
+				case err := <-errs:
+					t.Errorf("OnError received %s", err)
+				default:
+				}
+				return
+			}
+
+			expectTimeout(t, sendErr, "write", test.writeTimeout)
+			expectTimeout(t, receive(t, errs, "OnError"), "write", test.writeTimeout)
+			if want := (closeStatus{CloseAbnormalClosure, "Write timeout"}); status != want {
+				t.Errorf("OnDisconnect received %v, want %v", status, want)
+			}
+		})
+	}
+}